@@ -3,32 +3,201 @@ package api
 import "time"
 
 type Msg struct {
-	Type   string    `json:"type" binding:"required"`
+	Type string `json:"type" binding:"required"`
+	// Unique ID assigned by the server
+	ID string `json:"id,omitempty"`
+	// Sequence number assigned by the message bus. It grows monotonically within a room
+	// (or a direct conversation) and is 0 for messages that don't go through the bus.
+	Seq    int64     `json:"seq,omitempty"`
 	SentAt time.Time `json:"sent_at"`
-	Msg    any       `json:"msg,omitempty" binding:"required,omitempty"`
+	// Set by the client to match the server replies (like errors) with its messages
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Msg         any    `json:"msg,omitempty" binding:"required,omitempty"`
 }
 
 type UserJoinedMsg struct {
 	UserName string `json:"username"`
+	Room     string `json:"room"`
+	// Server the user joined, used only between servers
+	ServerID string `json:"server_id,omitempty"`
+	// Order of the presence messages of the server, used only between servers
+	Version int64 `json:"version,omitempty"`
 }
 
 type UserLeftMsg struct {
 	UserName string `json:"username"`
+	Room     string `json:"room"`
+	// Server the user left, used only between servers
+	ServerID string `json:"server_id,omitempty"`
+	// Order of the presence messages of the server, used only between servers
+	Version int64 `json:"version,omitempty"`
+}
+
+// Presence statuses
+const (
+	StatusOnline = "online"
+	StatusAway   = "away"
+	// Do not disturb
+	StatusBusy = "busy"
+)
+
+type UserPresence struct {
+	UserName   string `json:"username"`
+	Status     string `json:"status"`
+	StatusText string `json:"status_text,omitempty"`
 }
 
 type UsersOnline struct {
-	List []string `json:"list"`
+	Room string         `json:"room"`
+	List []UserPresence `json:"list"`
+}
+
+// Sent by the client to change its presence status
+type SetStatus struct {
+	Status     string `json:"status"`
+	StatusText string `json:"status_text,omitempty"`
+}
+
+type UserStatusChanged struct {
+	UserName   string `json:"username"`
+	Room       string `json:"room,omitempty"`
+	Status     string `json:"status"`
+	StatusText string `json:"status_text,omitempty"`
+	// Server the status was changed on, used only between servers
+	ServerID string `json:"server_id,omitempty"`
+	// Order of the presence messages of the server, used only between servers
+	Version int64 `json:"version,omitempty"`
+}
+
+// Servers periodically advertise all their users
+type ServerHeartbeat struct {
+	ServerID string        `json:"server_id"`
+	Rooms    []UsersOnline `json:"rooms"`
+	// Last time the users of the server were active, users inactive
+	// on all the servers become away
+	ActiveAt map[string]time.Time `json:"active_at,omitempty"`
+	// Order of the presence messages of the server
+	Version int64 `json:"version,omitempty"`
 }
 
 type ChatMessage struct {
+	Room string `json:"room"`
 	From string `json:"from_user"`
 	Text string `json:"text"`
+	// Set if the message was edited
+	EditedAt *time.Time `json:"edited_at,omitempty"`
 }
 
+// Sent by the client to edit its chat message
+type EditMessage struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// Sent by the client to delete its chat message
+type DeleteMessage struct {
+	ID string `json:"id"`
+}
+
+type MessageEdited struct {
+	ID       string `json:"id"`
+	Room     string `json:"room"`
+	Text     string `json:"text"`
+	EditedBy string `json:"edited_by"`
+}
+
+type MessageDeleted struct {
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	DeletedBy string `json:"deleted_by"`
+}
+
+type DirectMessage struct {
+	From string `json:"from_user"`
+	To   string `json:"to_user"`
+	Text string `json:"text"`
+}
+
+type UserTyping struct {
+	UserName string `json:"username"`
+	Room     string `json:"room"`
+}
+
+// Sent by the client as the first message if it didn't authenticate
+// when opening the websocket. Either the token or the ticket is required.
+type Auth struct {
+	Token  string `json:"token,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// Sent before the server closes the connection because it's shutting down.
+// The client should reconnect (likely to another server) after the delay.
+type Reconnect struct {
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// Tells all the servers to disconnect the websockets of the revoked
+// login session, used only between servers
+type SessionRevoked struct {
+	SessionID string `json:"session_id"`
+}
+
+// Sent to the client when its message was accepted by the message bus
+type Ack struct {
+	// ID assigned to the message
+	ID     string    `json:"id"`
+	SentAt time.Time `json:"sent_at"`
+	// client_msg_id of the message
+	ClientMsgID string `json:"client_msg_id"`
+}
+
+// Sent to the client when its message is rejected
+type Error struct {
+	Code string `json:"code"`
+	Text string `json:"text"`
+	// client_msg_id of the rejected message
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+}
+
+// Error codes
+const (
+	ErrorInvalidMessage   = "invalid_message"
+	ErrorUnsupportedType  = "unsupported_type"
+	ErrorTooLong          = "too_long"
+	ErrorRateLimited      = "rate_limited"
+	ErrorPermissionDenied = "permission_denied"
+	ErrorNotFound         = "not_found"
+	ErrorDeliveryFailed   = "delivery_failed"
+	ErrorInternal         = "internal_error"
+	// Sent right before the connection is closed because the user logged out
+	ErrorSessionRevoked = "session_revoked"
+	// Sent right before the connection is closed because the auth message
+	// is missing or invalid
+	ErrorUnauthorized = "unauthorized"
+)
+
+// Room used when the client doesn't specify one
+const DefaultRoom = "lobby"
+
 const (
-	TypeServerJoined = "server_joined"
-	TypeUserJoined   = "user_joined"
-	TypeUserLeft     = "user_left"
-	TypeUsersOnline  = "users_online"
-	TypeChatMessage  = "chat_message"
+	TypeServerHeartbeat   = "server_heartbeat"
+	TypeAuth              = "auth"
+	TypeUserJoined        = "user_joined"
+	TypeUserLeft          = "user_left"
+	TypeUsersOnline       = "users_online"
+	TypeSetStatus         = "set_status"
+	TypeUserStatusChanged = "user_status_changed"
+	TypeChatMessage       = "chat_message"
+	TypeDirectMessage     = "direct_message"
+	TypeEditMessage       = "edit_message"
+	TypeDeleteMessage     = "delete_message"
+	TypeMessageEdited     = "message_edited"
+	TypeMessageDeleted    = "message_deleted"
+	TypeTyping            = "typing"
+	TypeUserTyping        = "user_typing"
+	TypeUserStoppedTyping = "user_stopped_typing"
+	TypeReconnect         = "reconnect"
+	TypeSessionRevoked    = "session_revoked"
+	TypeError             = "error"
+	TypeAck               = "ack"
 )
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	*Keys
+}
+
+func NewHandler(k *Keys) *Handler {
+	return &Handler{k}
+}
+
+func (h *Handler) Route(root gin.IRouter) {
+	root.GET("/.well-known/jwks.json", h.GetJWKS)
+}
+
+func (h *Handler) GetJWKS(c *gin.Context) {
+	jwks, err := h.Keys.JWKS()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type Config struct {
+	// PEM file with the RSA or Ed25519 private key signing the tokens issued by ich.
+	// Tokens are signed with ICH_SERVER_SECRET (HS256) if it isn't set.
+	SigningKey string `env:"ICH_JWT_SIGNING_KEY"`
+	// kid of the signing key, derived from the key if not set
+	SigningKeyID string `env:"ICH_JWT_SIGNING_KEY_ID"`
+	// Other public keys accepted for verification, e.g. the previous signing key
+	// during rotation. Every key is kid=path to PEM file, separated by ';'.
+	PublicKeys []string `env:"ICH_JWT_PUBLIC_KEYS, delimiter=;"`
+	// JWKS document with more public keys, http(s) URL or path to a local file
+	JWKS string `env:"ICH_JWT_JWKS"`
+	// How often the JWKS document is reloaded
+	JWKSRefreshInterval time.Duration `env:"ICH_JWT_JWKS_REFRESH_INTERVAL, default=10m"`
+	// Expected iss and aud of the tokens, not checked if empty.
+	// The tokens issued by ich carry them as well.
+	Issuer   string `env:"ICH_JWT_ISSUER"`
+	Audience string `env:"ICH_JWT_AUDIENCE"`
+	// Claims holding the user name and ID, e.g. "preferred_username" and "sub"
+	// for an OpenID Connect provider
+	UserNameClaim string `env:"ICH_JWT_USERNAME_CLAIM, default=username"`
+	UserIDClaim   string `env:"ICH_JWT_USER_ID_CLAIM, default=id"`
+}
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Tokens signed with an unknown kid make the JWKS document reload at most this often
+const minReloadInterval = time.Minute
+
+var (
+	ErrUnknownKey    = errors.New("unknown signing key")
+	ErrInvalidClaims = errors.New("invalid token claims")
+)
+
+// Keys sign the tokens issued by ich and verify the tokens by their kid
+type Keys struct {
+	cfg Config
+	// Shared secret of HS256 tokens, nil if they aren't accepted
+	secret []byte
+
+	// Nil if ich signs the tokens with the secret
+	signingKey    crypto.Signer
+	signingKeyID  string
+	signingMethod jwt.SigningMethod
+
+	// Configured public keys, including the one of the signing key
+	local map[string]crypto.PublicKey
+
+	// Public keys from the JWKS document
+	remote         map[string]crypto.PublicKey
+	remoteLoadedAt time.Time
+	remoteMutex    sync.Mutex
+
+	wg sync.WaitGroup
+}
+
+func NewKeys(cfg Config, serverSecret string) (*Keys, error) {
+	k := &Keys{
+		cfg:    cfg,
+		local:  make(map[string]crypto.PublicKey),
+		remote: make(map[string]crypto.PublicKey),
+	}
+	if serverSecret != "" {
+		k.secret = []byte(serverSecret)
+	}
+
+	if cfg.SigningKey != "" {
+		key, err := readPrivateKey(cfg.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		k.signingKey = key
+		k.signingKeyID = cfg.SigningKeyID
+		if k.signingKeyID == "" {
+			k.signingKeyID, err = keyID(key.Public())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			k.signingMethod = jwt.SigningMethodRS256
+		} else {
+			k.signingMethod = jwt.SigningMethodEdDSA
+		}
+		k.local[k.signingKeyID] = key.Public()
+	}
+
+	for _, entry := range cfg.PublicKeys {
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("public key %q must be kid=path", entry)
+		}
+		key, err := readPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		k.local[kid] = key
+	}
+
+	if cfg.JWKS != "" {
+		jwks, err := loadJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		k.remote = jwks.publicKeys()
+		k.remoteLoadedAt = time.Now()
+	}
+
+	if k.secret == nil && len(k.local) == 0 && cfg.JWKS == "" {
+		return nil, errors.New("no keys to verify the tokens: either the server secret, the signing key, the public keys or the JWKS is required")
+	}
+	return k, nil
+}
+
+// Sign signs the claims with the signing key, or with the secret if there is no key
+func (k *Keys) Sign(claims jwt.Claims) (string, error) {
+	if k.signingKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+	token := jwt.NewWithClaims(k.signingMethod, claims)
+	token.Header["kid"] = k.signingKeyID
+	return token.SignedString(k.signingKey)
+}
+
+// Parse verifies the signature of the token, its expiration and not before times,
+// and the issuer and audience if they are configured
+func (k *Keys) Parse(tokenString string) (jwt.MapClaims, error) {
+	methods := []string{AlgRS256, AlgEdDSA}
+	if k.secret != nil {
+		methods = append(methods, AlgHS256)
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, k.keyfunc, jwt.WithValidMethods(methods))
+	if err != nil {
+		return nil, err
+	}
+	// The parser checks exp only if it's present
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%w: no exp", ErrInvalidClaims)
+	}
+	if k.cfg.Issuer != "" && !claims.VerifyIssuer(k.cfg.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected iss", ErrInvalidClaims)
+	}
+	if k.cfg.Audience != "" && !claims.VerifyAudience(k.cfg.Audience, true) {
+		return nil, fmt.Errorf("%w: unexpected aud", ErrInvalidClaims)
+	}
+	return claims, nil
+}
+
+// Identity returns the user name and ID from the configured claims.
+// The user name is required.
+func (k *Keys) Identity(claims jwt.MapClaims) (userName, userID string, err error) {
+	userName, ok := claimString(claims[k.cfg.UserNameClaim])
+	if !ok || userName == "" {
+		return "", "", fmt.Errorf("%w: no %v", ErrInvalidClaims, k.cfg.UserNameClaim)
+	}
+	userID, ok = claimString(claims[k.cfg.UserIDClaim])
+	if !ok {
+		return "", "", fmt.Errorf("%w: invalid %v", ErrInvalidClaims, k.cfg.UserIDClaim)
+	}
+	return userName, userID, nil
+}
+
+// Some issuers use numeric user IDs
+func claimString(value any) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// RegisteredClaims returns the claims of the tokens issued by ich
+func (k *Keys) RegisteredClaims(subject string, expiresAt time.Time) jwt.RegisteredClaims {
+	claims := jwt.RegisteredClaims{
+		Issuer:    k.cfg.Issuer,
+		Subject:   subject,
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	if k.cfg.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{k.cfg.Audience}
+	}
+	return claims
+}
+
+func (k *Keys) keyfunc(token *jwt.Token) (any, error) {
+	if token.Method.Alg() == AlgHS256 {
+		return k.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := k.local[kid]; ok {
+		return key, nil
+	}
+	if key := k.remoteKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// remoteKey reloads the JWKS document if the key isn't there,
+// the issuer might have rotated its keys
+func (k *Keys) remoteKey(kid string) crypto.PublicKey {
+	k.remoteMutex.Lock()
+	key, ok := k.remote[kid]
+	reload := !ok && k.cfg.JWKS != "" && time.Since(k.remoteLoadedAt) > minReloadInterval
+	if reload {
+		k.remoteLoadedAt = time.Now()
+	}
+	k.remoteMutex.Unlock()
+
+	if !reload {
+		return key
+	}
+	k.reload()
+
+	k.remoteMutex.Lock()
+	defer k.remoteMutex.Unlock()
+	return k.remote[kid]
+}
+
+func (k *Keys) reload() {
+	jwks, err := loadJWKS(k.cfg.JWKS)
+	if err != nil {
+		log.Printf("Can't reload JWKS: %v", err)
+		return
+	}
+	keys := jwks.publicKeys()
+	k.remoteMutex.Lock()
+	k.remote = keys
+	k.remoteLoadedAt = time.Now()
+	k.remoteMutex.Unlock()
+}
+
+// Run periodically reloads the JWKS document
+func (k *Keys) Run(ctx context.Context) {
+	k.wg.Add(1)
+	defer k.wg.Done()
+	if k.cfg.JWKS == "" || k.cfg.JWKSRefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(k.cfg.JWKSRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			k.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (k *Keys) Wait() {
+	k.wg.Wait()
+}
+
+// CanSign returns true if ich can issue tokens
+func (k *Keys) CanSign() bool {
+	return k.signingKey != nil || k.secret != nil
+}
+
+// Issuing returns true if ich signs its tokens with a private key,
+// so other services can verify them with the public keys
+func (k *Keys) Issuing() bool {
+	return k.signingKey != nil
+}
+
+// JWKS returns the configured public keys, including the one of the signing key.
+// Keys from the JWKS document aren't included, they belong to another issuer.
+func (k *Keys) JWKS() (*JWKS, error) {
+	jwks := &JWKS{Keys: make([]JWK, 0, len(k.local))}
+	for kid, key := range k.local {
+		jwk, err := toJWK(kid, key)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// keyID derives the kid from the public key, so it changes with the key
+func keyID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(der)
+	return b64.EncodeToString(hash[:12]), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %v", path)
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %v", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the private key in %v: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T in %v", key, path)
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %v", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the public key in %v: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T in %v", key, path)
+}
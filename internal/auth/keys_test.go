@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func writePrivateKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return writePEM(t, "PRIVATE KEY", der)
+}
+
+func writePublicKey(t *testing.T, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return writePEM(t, "PUBLIC KEY", der)
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"username": "Patrick",
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	for _, key := range []crypto.Signer{edKey, rsaKey} {
+		keys, err := NewKeys(Config{SigningKey: writePrivateKey(t, key)}, "")
+		require.NoError(t, err)
+		require.True(t, keys.Issuing())
+
+		token, err := keys.Sign(claims())
+		require.NoError(t, err)
+		parsed, err := keys.Parse(token)
+		require.NoError(t, err)
+		require.Equal(t, "Patrick", parsed["username"])
+
+		// The public key is published
+		jwks, err := keys.JWKS()
+		require.NoError(t, err)
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, keys.signingKeyID, jwks.Keys[0].Kid)
+
+		// HS256 tokens aren't accepted without the secret
+		hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString([]byte("secret"))
+		require.NoError(t, err)
+		_, err = keys.Parse(hs256)
+		require.Error(t, err)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	_, err := NewKeys(Config{}, "")
+	require.Error(t, err)
+
+	keys, err := NewKeys(Config{}, "secret")
+	require.NoError(t, err)
+	require.False(t, keys.Issuing())
+
+	token, err := keys.Sign(claims())
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	require.NoError(t, err)
+
+	other, err := NewKeys(Config{}, "other secret")
+	require.NoError(t, err)
+	_, err = other.Parse(token)
+	require.Error(t, err)
+}
+
+func TestRotation(t *testing.T) {
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	oldKeys, err := NewKeys(Config{SigningKey: writePrivateKey(t, oldKey), SigningKeyID: "old"}, "")
+	require.NoError(t, err)
+	oldToken, err := oldKeys.Sign(claims())
+	require.NoError(t, err)
+
+	// The old key still verifies the tokens signed before the rotation
+	newKeys, err := NewKeys(Config{
+		SigningKey:   writePrivateKey(t, newKey),
+		SigningKeyID: "new",
+		PublicKeys:   []string{"old=" + writePublicKey(t, oldKey.Public())},
+	}, "")
+	require.NoError(t, err)
+	_, err = newKeys.Parse(oldToken)
+	require.NoError(t, err)
+	newToken, err := newKeys.Sign(claims())
+	require.NoError(t, err)
+	_, err = newKeys.Parse(newToken)
+	require.NoError(t, err)
+
+	jwks, err := newKeys.JWKS()
+	require.NoError(t, err)
+	require.Len(t, jwks.Keys, 2)
+
+	// Not after it's removed
+	_, err = oldKeys.Parse(newToken)
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestJWKS(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// Issuer publishing its keys
+	issuer, err := NewKeys(Config{
+		SigningKey:   writePrivateKey(t, edKey),
+		SigningKeyID: "ed",
+	}, "")
+	require.NoError(t, err)
+	published, err := issuer.JWKS()
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(published)
+	}))
+	defer server.Close()
+
+	keys, err := NewKeys(Config{JWKS: server.URL}, "secret")
+	require.NoError(t, err)
+	token, err := issuer.Sign(claims())
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	require.NoError(t, err)
+
+	// The issuer rotates its key, the JWKS is reloaded for the unknown kid
+	issuer, err = NewKeys(Config{
+		SigningKey:   writePrivateKey(t, rsaKey),
+		SigningKeyID: "rsa",
+	}, "")
+	require.NoError(t, err)
+	published, err = issuer.JWKS()
+	require.NoError(t, err)
+	token, err = issuer.Sign(claims())
+	require.NoError(t, err)
+
+	// But not too often
+	_, err = keys.Parse(token)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	keys.remoteLoadedAt = time.Now().Add(-minReloadInterval - time.Second)
+	_, err = keys.Parse(token)
+	require.NoError(t, err)
+
+	// From a file too
+	data, err := json.Marshal(published)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	keys, err = NewKeys(Config{JWKS: path}, "secret")
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	require.NoError(t, err)
+}
+
+func TestExternalIssuer(t *testing.T) {
+	_, idpKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	idp, err := NewKeys(Config{SigningKey: writePrivateKey(t, idpKey), SigningKeyID: "idp"}, "")
+	require.NoError(t, err)
+
+	keys, err := NewKeys(Config{
+		PublicKeys:    []string{"idp=" + writePublicKey(t, idpKey.Public())},
+		Issuer:        "https://auth.example.com",
+		Audience:      "ich",
+		UserNameClaim: "preferred_username",
+		UserIDClaim:   "sub",
+	}, "")
+	require.NoError(t, err)
+	require.False(t, keys.CanSign())
+
+	token := func(claims jwt.MapClaims) string {
+		t.Helper()
+		ss, err := idp.Sign(claims)
+		require.NoError(t, err)
+		return ss
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":                "https://auth.example.com",
+			"aud":                []string{"ich", "other"},
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"sub":                42,
+			"preferred_username": "Patrick",
+		}
+	}
+
+	claims, err := keys.Parse(token(valid()))
+	require.NoError(t, err)
+	userName, userID, err := keys.Identity(claims)
+	require.NoError(t, err)
+	require.Equal(t, "Patrick", userName)
+	require.Equal(t, "42", userID)
+
+	for name, change := range map[string]func(jwt.MapClaims){
+		"issuer":     func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"audience":   func(c jwt.MapClaims) { c["aud"] = "other" },
+		"no exp":     func(c jwt.MapClaims) { delete(c, "exp") },
+		"expired":    func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"not before": func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Minute).Unix() },
+	} {
+		claims := valid()
+		change(claims)
+		_, err := keys.Parse(token(claims))
+		require.Error(t, err, name)
+	}
+
+	claims = valid()
+	delete(claims, "preferred_username")
+	claims, err = keys.Parse(token(claims))
+	require.NoError(t, err)
+	_, _, err = keys.Identity(claims)
+	require.ErrorIs(t, err, ErrInvalidClaims)
+}
@@ -0,0 +1,41 @@
+package bus
+
+import "context"
+
+// Message received from the bus
+type Message struct {
+	Key  string
+	Data []byte
+	// Sequence number of the message, always greater than 0. Sequence numbers
+	// grow monotonically for the messages with the same key.
+	Seq int64
+}
+
+type Receiver interface {
+	Receive(*Message) error
+}
+
+// Bus delivers every published message to all the receivers subscribed to it
+// on every server instance connected to the same bus
+type Bus interface {
+	// Messages published with the same key are received in the same order
+	// by all the receivers. The key may be empty if the order doesn't matter.
+	// Publish returns when the bus accepted the message.
+	Publish(key string, data []byte) error
+	Subscribe(Receiver)
+	Unsubscribe(Receiver)
+	// Run blocks until the context is done
+	Run(ctx context.Context)
+	// Wait waits for Run to return
+	Wait()
+	Close()
+}
+
+// Compacted is a bus that keeps the latest message published with every key,
+// like a log-compacted Kafka topic
+type Compacted interface {
+	Bus
+	// Snapshot returns the latest message for every key. Publishing nil data
+	// deletes the key from the snapshot.
+	Snapshot(ctx context.Context) ([]*Message, error)
+}
@@ -0,0 +1,156 @@
+package bus
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process Bus. It connects the components of a single server
+// instance, which makes it possible to run the server and the tests without Kafka.
+type Memory struct {
+	// Publish doesn't block, so receivers can publish while handling a message
+	queue      []*Message
+	queueMutex sync.Mutex
+	notify     chan struct{}
+	lastSeq    int64
+
+	receivers      map[Receiver]struct{}
+	receiversMutex sync.Mutex
+
+	wg *sync.WaitGroup
+}
+
+var _ Bus = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		notify:    make(chan struct{}, 1),
+		receivers: make(map[Receiver]struct{}),
+		wg:        &sync.WaitGroup{},
+	}
+}
+
+func (m *Memory) Subscribe(r Receiver) {
+	m.receiversMutex.Lock()
+	m.receivers[r] = struct{}{}
+	m.receiversMutex.Unlock()
+}
+
+func (m *Memory) Unsubscribe(r Receiver) {
+	m.receiversMutex.Lock()
+	delete(m.receivers, r)
+	m.receiversMutex.Unlock()
+}
+
+// All the messages are delivered in the order they were published, regardless of the key
+func (m *Memory) Publish(key string, data []byte) error {
+	m.queueMutex.Lock()
+	m.lastSeq++
+	m.queue = append(m.queue, &Message{
+		Key:  key,
+		Data: data,
+		Seq:  m.lastSeq,
+	})
+	m.queueMutex.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers the published messages. It must be called only once per bus.
+func (m *Memory) Run(ctx context.Context) {
+	m.wg.Add(1)
+Loop:
+	for {
+		select {
+		case <-m.notify:
+			m.deliver()
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	m.wg.Done()
+}
+
+// seq returns the sequence number of the last published message
+func (m *Memory) seq() int64 {
+	m.queueMutex.Lock()
+	defer m.queueMutex.Unlock()
+	return m.lastSeq
+}
+
+func (m *Memory) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Memory) Close() {
+}
+
+func (m *Memory) deliver() {
+	for {
+		m.queueMutex.Lock()
+		queue := m.queue
+		m.queue = nil
+		m.queueMutex.Unlock()
+
+		if len(queue) == 0 {
+			return
+		}
+
+		m.receiversMutex.Lock()
+		for _, msg := range queue {
+			for r := range m.receivers {
+				r.Receive(msg)
+			}
+		}
+		m.receiversMutex.Unlock()
+	}
+}
+
+// CompactedMemory is an in-process Compacted bus
+type CompactedMemory struct {
+	*Memory
+
+	latest      map[string]*Message
+	latestMutex sync.Mutex
+}
+
+var _ Compacted = (*CompactedMemory)(nil)
+
+func NewCompactedMemory() *CompactedMemory {
+	return &CompactedMemory{
+		Memory: NewMemory(),
+		latest: make(map[string]*Message),
+	}
+}
+
+func (m *CompactedMemory) Publish(key string, data []byte) error {
+	// Keep the latest message and publish it while holding the lock,
+	// so the snapshot has the same order as the published messages
+	m.latestMutex.Lock()
+	defer m.latestMutex.Unlock()
+	m.Memory.Publish(key, data)
+	if data == nil {
+		delete(m.latest, key)
+		return nil
+	}
+	m.latest[key] = &Message{
+		Key:  key,
+		Data: data,
+		Seq:  m.Memory.seq(),
+	}
+	return nil
+}
+
+func (m *CompactedMemory) Snapshot(ctx context.Context) ([]*Message, error) {
+	m.latestMutex.Lock()
+	defer m.latestMutex.Unlock()
+	res := make([]*Message, 0, len(m.latest))
+	for _, msg := range m.latest {
+		res = append(res, msg)
+	}
+	return res, nil
+}
@@ -0,0 +1,90 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type MockReceiver struct {
+	bus *Memory
+
+	received      [][]byte
+	seqs          []int64
+	receivedMutex sync.Mutex
+}
+
+func (r *MockReceiver) Receive(msg *Message) error {
+	r.receivedMutex.Lock()
+	r.received = append(r.received, msg.Data)
+	r.seqs = append(r.seqs, msg.Seq)
+	r.receivedMutex.Unlock()
+
+	// Receivers may publish while handling a message
+	if string(msg.Data) == "ping" {
+		r.bus.Publish("", []byte("pong"))
+	}
+	return nil
+}
+
+func (r *MockReceiver) Received() [][]byte {
+	r.receivedMutex.Lock()
+	defer r.receivedMutex.Unlock()
+	return append([][]byte(nil), r.received...)
+}
+
+func TestMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewMemory()
+	go bus.Run(ctx)
+
+	receiver := &MockReceiver{bus: bus}
+	bus.Subscribe(receiver)
+
+	bus.Publish("", []byte("hello"))
+	bus.Publish("", []byte("ping"))
+
+	require.Eventually(t, func() bool {
+		return len(receiver.Received()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, [][]byte{[]byte("hello"), []byte("ping"), []byte("pong")}, receiver.Received())
+	require.Equal(t, []int64{1, 2, 3}, receiver.seqs)
+
+	bus.Unsubscribe(receiver)
+	bus.Publish("", []byte("hello"))
+
+	cancel()
+	bus.Wait()
+
+	require.Equal(t, 3, len(receiver.Received()))
+}
+
+func TestCompactedMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewCompactedMemory()
+	go bus.Run(ctx)
+
+	bus.Publish("a", []byte("1"))
+	bus.Publish("b", []byte("2"))
+	bus.Publish("a", []byte("3"))
+	bus.Publish("c", []byte("4"))
+	// Deletes c
+	bus.Publish("c", nil)
+
+	snapshot, err := bus.Snapshot(ctx)
+	require.NoError(t, err)
+
+	latest := make(map[string]string)
+	for _, msg := range snapshot {
+		latest[msg.Key] = string(msg.Data)
+	}
+	require.Equal(t, map[string]string{"a": "3", "b": "2"}, latest)
+}
@@ -0,0 +1,201 @@
+package cors
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Config struct {
+	// Origins of the web apps allowed to call the API and open websockets, separated
+	// by ';'. "https://*.example.com" allows all the subdomains of example.com and
+	// "*" allows any origin. Only the same origin is allowed if it's empty.
+	AllowedOrigins []string `env:"ICH_ALLOWED_ORIGINS, delimiter=;"`
+}
+
+// Subdomains of the domain with the scheme and port
+type wildcard struct {
+	scheme string
+	// Starts with a dot
+	suffix string
+	port   string
+}
+
+// Origins is the allow-list of the browser origins
+type Origins struct {
+	any       bool
+	exact     map[string]struct{}
+	wildcards []wildcard
+	// Reverse proxies allowed to tell the scheme of the request with X-Forwarded-Proto
+	trustedProxies []*net.IPNet
+}
+
+// NewOrigins takes the addresses or CIDRs of the trusted reverse proxies, the server
+// behind a proxy terminating TLS learns the scheme of the request from them
+func NewOrigins(cfg Config, trustedProxies []string) (*Origins, error) {
+	o := &Origins{
+		exact: make(map[string]struct{}),
+	}
+	for _, proxy := range trustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		o.trustedProxies = append(o.trustedProxies, network)
+	}
+	for _, pattern := range cfg.AllowedOrigins {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			o.any = true
+			continue
+		}
+		u, err := url.Parse(pattern)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid allowed origin %q, must be like https://example.com", pattern)
+		}
+		if domain, ok := strings.CutPrefix(u.Hostname(), "*."); ok {
+			if domain == "" || strings.Contains(domain, "*") {
+				return nil, fmt.Errorf("invalid allowed origin %q", pattern)
+			}
+			o.wildcards = append(o.wildcards, wildcard{scheme: u.Scheme, suffix: "." + domain, port: u.Port()})
+			continue
+		}
+		if strings.Contains(u.Host, "*") {
+			return nil, fmt.Errorf("invalid allowed origin %q, only the leftmost label can be a wildcard", pattern)
+		}
+		o.exact[u.Scheme+"://"+u.Host] = struct{}{}
+	}
+	return o, nil
+}
+
+// Allowed returns true if the origin is in the allow-list
+func (o *Origins) Allowed(origin string) bool {
+	if o.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if _, ok := o.exact[origin]; ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, w := range o.wildcards {
+		if u.Scheme == w.scheme && u.Port() == w.port && strings.HasSuffix(u.Hostname(), w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetwork(proxy string) (*net.IPNet, error) {
+	proxy = strings.TrimSpace(proxy)
+	if strings.Contains(proxy, "/") {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Requests from the page served by the same scheme and host don't need to be allowed
+func (o *Origins) sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, o.scheme(r)) && strings.EqualFold(u.Host, r.Host)
+}
+
+// scheme returns the scheme the client used, the trusted proxies tell it
+// with X-Forwarded-Proto
+func (o *Origins) scheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && o.fromTrustedProxy(r) {
+		proto, _, _ = strings.Cut(proto, ",")
+		return strings.TrimSpace(proto)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (o *Origins) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range o.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin allows the websocket handshakes from the same or the allowed origins,
+// and from the clients other than browsers, they don't send the origin.
+// It prevents cross-site websocket hijacking.
+func (o *Origins) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || o.sameOrigin(r, origin) || o.Allowed(origin) {
+		return true
+	}
+	log.Printf("Rejected websocket from the origin %q", origin)
+	return false
+}
+
+// Middleware lets the web apps from the allowed origins call the API.
+// Requests from other origins aren't rejected, browsers just don't let the apps
+// read the responses, but their preflight requests are.
+func (o *Origins) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || o.sameOrigin(c.Request, origin) {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		c.Header("Vary", "Origin")
+		if !o.Allowed(origin) {
+			log.Printf("Rejected %v %v from the origin %q", c.Request.Method, c.Request.URL.Path, origin)
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
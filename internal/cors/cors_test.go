@@ -0,0 +1,122 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrigins(t *testing.T) {
+	o, err := NewOrigins(Config{AllowedOrigins: []string{
+		"https://chat.example.com",
+		"https://*.example.org",
+		"http://localhost:3000",
+	}}, nil)
+	require.NoError(t, err)
+
+	require.True(t, o.Allowed("https://chat.example.com"))
+	require.True(t, o.Allowed("https://CHAT.example.com"))
+	require.False(t, o.Allowed("http://chat.example.com"))
+	require.False(t, o.Allowed("https://evil.example.com"))
+	require.False(t, o.Allowed("https://chat.example.com.evil.com"))
+
+	require.True(t, o.Allowed("https://app.example.org"))
+	require.True(t, o.Allowed("https://a.b.example.org"))
+	require.False(t, o.Allowed("https://example.org"))
+	require.False(t, o.Allowed("https://evilexample.org"))
+	require.False(t, o.Allowed("https://app.example.org:8443"))
+
+	require.True(t, o.Allowed("http://localhost:3000"))
+	require.False(t, o.Allowed("http://localhost:3001"))
+
+	for _, pattern := range []string{"example.com", "https://example.com/path", "https://a.*.example.com", "https://*."} {
+		_, err := NewOrigins(Config{AllowedOrigins: []string{pattern}}, nil)
+		require.Error(t, err, pattern)
+	}
+
+	o, err = NewOrigins(Config{AllowedOrigins: []string{"*"}}, nil)
+	require.NoError(t, err)
+	require.True(t, o.Allowed("https://anything.example.com"))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	o, err := NewOrigins(Config{AllowedOrigins: []string{"https://chat.example.com"}}, []string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "http://ich.example.com/join", nil)
+	// Not a browser
+	require.True(t, o.CheckOrigin(r))
+
+	r.Header.Set("Origin", "http://ich.example.com")
+	require.True(t, o.CheckOrigin(r))
+
+	r.Header.Set("Origin", "https://chat.example.com")
+	require.True(t, o.CheckOrigin(r))
+
+	r.Header.Set("Origin", "https://evil.example.com")
+	require.False(t, o.CheckOrigin(r))
+
+	// A page on plain HTTP isn't the same origin as the server on HTTPS
+	r = httptest.NewRequest(http.MethodGet, "https://ich.example.com/join", nil)
+	r.Header.Set("Origin", "http://ich.example.com")
+	require.False(t, o.CheckOrigin(r))
+	r.Header.Set("Origin", "https://ich.example.com")
+	require.True(t, o.CheckOrigin(r))
+
+	// Only the trusted proxies tell the scheme
+	r = httptest.NewRequest(http.MethodGet, "http://ich.example.com/join", nil)
+	r.Header.Set("Origin", "https://ich.example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	require.False(t, o.CheckOrigin(r))
+	r.RemoteAddr = "10.0.0.1:1234"
+	require.True(t, o.CheckOrigin(r))
+
+	_, err = NewOrigins(Config{}, []string{"proxy"})
+	require.Error(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	o, err := NewOrigins(Config{AllowedOrigins: []string{"https://chat.example.com"}}, nil)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(o.Middleware())
+	router.POST("/login", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://ich.example.com/login", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodOptions, "https://chat.example.com")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, "https://chat.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	w = request(http.MethodPost, "https://chat.example.com")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "https://chat.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = request(http.MethodOptions, "https://evil.example.com")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = request(http.MethodPost, "https://evil.example.com")
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Same origin doesn't need CORS
+	w = request(http.MethodPost, "http://ich.example.com")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -14,12 +14,17 @@ import (
 //go:embed migrations
 var embedFS embed.FS
 
+// The database is optional when the users are managed by an external identity provider
 type Config struct {
-	Host     string `env:"ICH_DB_HOST, required"`
-	Port     string `env:"ICH_DB_PORT, required"`
-	User     string `env:"ICH_DB_USER, required"`
-	Password string `env:"ICH_DB_PASSWORD, required"`
-	Name     string `env:"ICH_DB_NAME, required"`
+	Host     string `env:"ICH_DB_HOST"`
+	Port     string `env:"ICH_DB_PORT"`
+	User     string `env:"ICH_DB_USER"`
+	Password string `env:"ICH_DB_PASSWORD"`
+	Name     string `env:"ICH_DB_NAME"`
+}
+
+func (cfg *Config) Configured() bool {
+	return cfg.Host != ""
 }
 
 func Connect(cfg *Config) (*sql.DB, error) {
@@ -0,0 +1,6 @@
+CREATE TABLE messages (
+    id bigserial PRIMARY KEY,
+    from_user varchar NOT NULL,
+    text varchar NOT NULL,
+    sent_at timestamptz NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN room varchar NOT NULL DEFAULT 'lobby';
+
+CREATE INDEX messages_room_id ON messages(room, id);
@@ -0,0 +1,6 @@
+ALTER TABLE messages ADD COLUMN message_id varchar;
+ALTER TABLE messages ADD COLUMN seq bigint NOT NULL DEFAULT 0;
+
+-- Every server instance consumes the whole messages topic and stores what it
+-- receives, so the same message is inserted once per instance
+CREATE UNIQUE INDEX messages_message_id ON messages(message_id);
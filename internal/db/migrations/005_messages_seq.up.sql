@@ -0,0 +1 @@
+CREATE INDEX messages_room_seq ON messages(room, seq);
@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN edited_at timestamptz;
+
+-- Deleted messages are kept, so a server instance that stores a message
+-- after another one has deleted it doesn't bring the message back
+ALTER TABLE messages ADD COLUMN deleted_at timestamptz;
@@ -0,0 +1,9 @@
+-- Token buckets of the rate limits, shared by all the server instances
+CREATE TABLE rate_limits (
+    key varchar PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamptz NOT NULL,
+    -- Time the bucket is full again, then it's the same as a missing one and can be removed
+    full_at timestamptz NOT NULL
+);
+CREATE INDEX rate_limits_full_at_idx ON rate_limits(full_at);
@@ -0,0 +1,9 @@
+-- Login sessions. The refresh token is replaced on every refresh,
+-- only its hash is stored. Revoking a session revokes all its tokens.
+CREATE TABLE sessions (
+    id varchar PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id),
+    refresh_token_hash varchar NOT NULL UNIQUE,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
@@ -0,0 +1,8 @@
+-- Single-use tickets opening a websocket without passing the access token in the URL
+CREATE TABLE ws_tickets (
+    id varchar PRIMARY KEY,
+    username varchar NOT NULL,
+    user_id varchar NOT NULL,
+    session_id varchar NOT NULL,
+    expires_at timestamptz NOT NULL
+);
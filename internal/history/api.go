@@ -0,0 +1,8 @@
+package history
+
+import "github.com/ig0rmin/ich/internal/api"
+
+type GetMessagesRes struct {
+	Messages   []*api.Msg `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,89 @@
+package history
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ig0rmin/ich/internal/api"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+type Handler struct {
+	*Repository
+}
+
+func NewHandler(r *Repository) *Handler {
+	return &Handler{r}
+}
+
+func (h *Handler) Route(root gin.IRouter) {
+	root.GET("/messages", h.GetMessages)
+}
+
+func (h *Handler) GetMessages(c *gin.Context) {
+	before, err := decodeCursor(c.Query("before"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := defaultPageSize
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(limit, maxPageSize)
+	}
+
+	room := c.DefaultQuery("room", api.DefaultRoom)
+
+	records, err := h.Repository.GetChatMessages(c.Request.Context(), room, before, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	res := &GetMessagesRes{
+		Messages: make([]*api.Msg, 0, len(records)),
+	}
+	for i := range records {
+		res.Messages = append(res.Messages, records[i].Msg())
+	}
+	// A full page means there might be more messages to load
+	if len(records) == limit {
+		res.NextCursor = encodeCursor(records[len(records)-1].ID)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// Cursors are opaque for clients, so we are free to change what's inside
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errBadCursor
+	}
+	return id, nil
+}
@@ -0,0 +1,23 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	id, err := decodeCursor(encodeCursor(42))
+	require.NoError(t, err)
+	require.Equal(t, int64(42), id)
+
+	id, err = decodeCursor("")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), id)
+
+	_, err = decodeCursor("not a cursor")
+	require.Error(t, err)
+
+	_, err = decodeCursor(encodeCursor(-1))
+	require.Error(t, err)
+}
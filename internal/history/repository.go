@@ -0,0 +1,140 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+)
+
+var ErrNotFound = errors.New("message not found")
+
+type Record struct {
+	// Position in the history, used for paging
+	ID int64
+	// Message ID and sequence number as assigned by the server
+	MessageID   string
+	Seq         int64
+	SentAt      time.Time
+	ChatMessage api.ChatMessage
+}
+
+func (r *Record) Msg() *api.Msg {
+	return &api.Msg{
+		Type:   api.TypeChatMessage,
+		ID:     r.MessageID,
+		Seq:    r.Seq,
+		SentAt: r.SentAt,
+		Msg:    &r.ChatMessage,
+	}
+}
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) SaveChatMessage(ctx context.Context, msg *api.Msg, chatMsg *api.ChatMessage) error {
+	query := `INSERT INTO messages(message_id, seq, room, from_user, text, sent_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (message_id) DO NOTHING`
+	_, err := r.db.ExecContext(ctx, query, msg.ID, msg.Seq, chatMsg.Room, chatMsg.From, chatMsg.Text, msg.SentAt)
+	return err
+}
+
+func (r *Repository) EditChatMessage(ctx context.Context, messageID string, text string, editedAt time.Time) error {
+	query := "UPDATE messages SET text = $2, edited_at = $3 WHERE message_id = $1 AND deleted_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, messageID, text, editedAt)
+	return err
+}
+
+func (r *Repository) DeleteChatMessage(ctx context.Context, messageID string, deletedAt time.Time) error {
+	query := "UPDATE messages SET text = '', deleted_at = $2 WHERE message_id = $1 AND deleted_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, messageID, deletedAt)
+	return err
+}
+
+func (r *Repository) GetChatMessage(ctx context.Context, messageID string) (*Record, error) {
+	query := "SELECT " + recordColumns + " FROM messages WHERE message_id = $1 AND deleted_at IS NULL"
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records, err := scanRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return &records[0], nil
+}
+
+// GetLastChatMessages returns up to limit most recent messages in the room, oldest first
+func (r *Repository) GetLastChatMessages(ctx context.Context, room string, limit int) ([]Record, error) {
+	query := `SELECT ` + recordColumns + ` FROM (
+		SELECT * FROM messages WHERE room = $1 AND deleted_at IS NULL ORDER BY id DESC LIMIT $2
+	) AS last ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query, room, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRecords(rows)
+}
+
+// GetChatMessagesSince returns messages in the room with sequence numbers greater than seq,
+// ordered by sequence number. If there are more than limit such messages, it returns the last ones.
+func (r *Repository) GetChatMessagesSince(ctx context.Context, room string, seq int64, limit int) ([]Record, error) {
+	query := `SELECT ` + recordColumns + ` FROM (
+		SELECT * FROM messages WHERE room = $1 AND seq > $2 AND deleted_at IS NULL ORDER BY seq DESC LIMIT $3
+	) AS missed ORDER BY seq`
+	rows, err := r.db.QueryContext(ctx, query, room, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRecords(rows)
+}
+
+// GetChatMessages returns up to limit messages in the room older than the message with the given id,
+// newest first. If before is 0, it starts from the most recent message.
+func (r *Repository) GetChatMessages(ctx context.Context, room string, before int64, limit int) ([]Record, error) {
+	query := "SELECT " + recordColumns + " FROM messages WHERE room = $1 AND ($2 = 0 OR id < $2) AND deleted_at IS NULL ORDER BY id DESC LIMIT $3"
+	rows, err := r.db.QueryContext(ctx, query, room, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRecords(rows)
+}
+
+// Columns read by scanRecords
+const recordColumns = "id, COALESCE(message_id, ''), seq, room, from_user, text, sent_at, edited_at"
+
+func scanRecords(rows *sql.Rows) ([]Record, error) {
+	var res []Record
+	for rows.Next() {
+		var rec Record
+		err := rows.Scan(
+			&rec.ID,
+			&rec.MessageID,
+			&rec.Seq,
+			&rec.ChatMessage.Room,
+			&rec.ChatMessage.From,
+			&rec.ChatMessage.Text,
+			&rec.SentAt,
+			&rec.ChatMessage.EditedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,167 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/messages"
+)
+
+type Config struct {
+	// Number of recent messages sent to a client when it joins
+	ReplayLength int `env:"ICH_HISTORY_REPLAY_LENGTH, default=50"`
+	// Maximum number of missed messages sent to a client when it resumes
+	ResumeLength int `env:"ICH_HISTORY_RESUME_LENGTH, default=1000"`
+}
+
+// Sink stores every chat message passing through Messages in the database.
+// The writes are buffered, so short DB hiccups don't delay the messages. When
+// the buffer is full the sink blocks the bus consumer until the DB catches up:
+// the messages are delivered late rather than missing from the history. On shutdown
+// the writes left in the buffer are done before the sink stops.
+type Sink struct {
+	repo     *Repository
+	messages *messages.Messages
+	// Pending DB writes, in the order of the messages
+	writes chan func(context.Context) error
+	// Closed when the write loop is done, so the consumer doesn't block forever
+	stopped chan struct{}
+
+	wg *sync.WaitGroup
+}
+
+const (
+	writeBufferSize = 1024
+	// A single write can't take longer
+	writeTimeout = 10 * time.Second
+	// On shutdown the writes left in the buffer are done within this time
+	drainTimeout = 30 * time.Second
+)
+
+var errSinkStopped = errors.New("history sink stopped")
+
+func NewSink(repo *Repository, messages *messages.Messages) *Sink {
+	return &Sink{
+		repo:     repo,
+		messages: messages,
+		writes:   make(chan func(context.Context) error, writeBufferSize),
+		stopped:  make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+func (s *Sink) Init() {
+	s.messages.Subscribe(messages.AllRooms, s)
+}
+
+func (s *Sink) Close() {
+	s.messages.Unsubscribe(messages.AllRooms, s)
+}
+
+func (s *Sink) ReceiveChatMessage(msg *api.Msg, chatMsg *api.ChatMessage) {
+	s.enqueue(func(ctx context.Context) error {
+		return s.repo.SaveChatMessage(ctx, msg, chatMsg)
+	})
+}
+
+func (s *Sink) ReceiveMessageEdited(msg *api.Msg, edited *api.MessageEdited) {
+	s.enqueue(func(ctx context.Context) error {
+		return s.repo.EditChatMessage(ctx, edited.ID, edited.Text, msg.SentAt)
+	})
+}
+
+func (s *Sink) ReceiveMessageDeleted(msg *api.Msg, deleted *api.MessageDeleted) {
+	s.enqueue(func(ctx context.Context) error {
+		return s.repo.DeleteChatMessage(ctx, deleted.ID, msg.SentAt)
+	})
+}
+
+// enqueue blocks while the buffer is full
+func (s *Sink) enqueue(write func(context.Context) error) {
+	select {
+	case s.writes <- write:
+		return
+	default:
+	}
+	log.Printf("Chat history writes are behind, delaying the messages")
+	select {
+	case s.writes <- write:
+	case <-s.stopped:
+	}
+}
+
+// Sync waits until the messages received so far are written to the database.
+// A client that subscribed to the messages before calling it gets the rest live,
+// so it misses nothing reading the history afterwards.
+func (s *Sink) Sync(ctx context.Context) error {
+	done := make(chan struct{})
+	barrier := func(context.Context) error {
+		close(done)
+		return nil
+	}
+	select {
+	case s.writes <- barrier:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.stopped:
+		return errSinkStopped
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.stopped:
+		return errSinkStopped
+	}
+}
+
+func (s *Sink) Run(ctx context.Context) {
+	log.Printf("Start history sink loop")
+	s.wg.Add(1)
+	defer close(s.stopped)
+Loop:
+	for {
+		select {
+		case write := <-s.writes:
+			// The write in progress isn't canceled on shutdown
+			s.write(context.Background(), write)
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	s.drain()
+	s.wg.Done()
+	log.Printf("Done history sink loop")
+}
+
+// drain does the writes left in the buffer, so the messages received
+// before the shutdown aren't missing from the history
+func (s *Sink) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for {
+		select {
+		case write := <-s.writes:
+			s.write(ctx, write)
+		default:
+			return
+		}
+	}
+}
+
+func (s *Sink) write(ctx context.Context, write func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := write(ctx); err != nil {
+		log.Printf("Failed to save chat history: %v", err)
+	}
+}
+
+func (s *Sink) Wait() {
+	s.wg.Wait()
+}
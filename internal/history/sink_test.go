@@ -0,0 +1,47 @@
+package history
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSink(nil, nil)
+	go s.Run(ctx)
+
+	// The writes queued before are done when Sync returns
+	var written bool
+	s.enqueue(func(context.Context) error {
+		written = true
+		return nil
+	})
+	require.NoError(t, s.Sync(context.Background()))
+	require.True(t, written)
+
+	cancel()
+	s.Wait()
+	syncCtx, syncCancel := context.WithTimeout(context.Background(), time.Second)
+	defer syncCancel()
+	require.Error(t, s.Sync(syncCtx))
+}
+
+func TestSinkDrain(t *testing.T) {
+	s := NewSink(nil, nil)
+	var written int
+	for i := 0; i < 3; i++ {
+		s.enqueue(func(context.Context) error {
+			written++
+			return nil
+		})
+	}
+
+	// The server is shutting down, but the queued writes are done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx)
+	require.Equal(t, 3, written)
+}
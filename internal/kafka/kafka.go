@@ -2,35 +2,55 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"log"
 	"sync"
 
 	"github.com/IBM/sarama"
+	"github.com/ig0rmin/ich/internal/bus"
 )
 
 type Config struct {
-	BootstrapServers []string `env:"ICH_KAFKA_BOOTSTRAP_SERVERS, delimiter=;, required"`
+	BootstrapServers []string `env:"ICH_KAFKA_BOOTSTRAP_SERVERS, delimiter=;"`
 }
 
 type Kafka struct {
-	topic             string
-	producer          sarama.SyncProducer
-	consumer          sarama.Consumer
-	partitionConsumer sarama.PartitionConsumer
-	publish           chan []byte
+	brokers  []string
+	topic    string
+	producer sarama.SyncProducer
+	consumer sarama.Consumer
+	// Every server instance consumes all the partitions of the topic
+	partitionConsumers []sarama.PartitionConsumer
+	// Set when the producer is closed, publishers hold the read lock
+	closed        bool
+	producerMutex sync.RWMutex
 
-	receivers      map[Receiver]struct{}
+	receivers      map[bus.Receiver]struct{}
 	receiversMutex sync.Mutex
 
 	wg *sync.WaitGroup
 }
 
-type Receiver interface {
-	Receive([]byte) error
-}
+var _ bus.Compacted = (*Kafka)(nil)
+
+var ErrStopped = errors.New("Kafka producer is stopped")
 
 func NewKafka(cfg Config, topic string) (*Kafka, error) {
-	producer, err := connectProducer(cfg.BootstrapServers)
+	return newKafka(cfg, topic, sarama.WaitForAll)
+}
+
+// NewEphemeralKafka is for messages that are fine to lose, like typing notifications.
+// It doesn't wait for Kafka to acknowledge published messages.
+func NewEphemeralKafka(cfg Config, topic string) (*Kafka, error) {
+	return newKafka(cfg, topic, sarama.NoResponse)
+}
+
+func newKafka(cfg Config, topic string, acks sarama.RequiredAcks) (*Kafka, error) {
+	if len(cfg.BootstrapServers) == 0 {
+		return nil, errors.New("Kafka bootstrap servers are not configured")
+	}
+
+	producer, err := connectProducer(cfg.BootstrapServers, acks)
 	if err != nil {
 		return nil, err
 	}
@@ -41,7 +61,7 @@ func NewKafka(cfg Config, topic string) (*Kafka, error) {
 		return nil, err
 	}
 
-	partitionConsumer, err := consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
+	partitionConsumers, err := consumePartitions(consumer, topic)
 	if err != nil {
 		producer.Close()
 		consumer.Close()
@@ -49,35 +69,159 @@ func NewKafka(cfg Config, topic string) (*Kafka, error) {
 	}
 
 	return &Kafka{
-		topic:             topic,
-		producer:          producer,
-		consumer:          consumer,
-		partitionConsumer: partitionConsumer,
-		publish:           make(chan []byte),
-		receivers:         make(map[Receiver]struct{}),
-		wg:                &sync.WaitGroup{},
+		brokers:            cfg.BootstrapServers,
+		topic:              topic,
+		producer:           producer,
+		consumer:           consumer,
+		partitionConsumers: partitionConsumers,
+		receivers:          make(map[bus.Receiver]struct{}),
+		wg:                 &sync.WaitGroup{},
 	}, nil
 }
 
-func (k *Kafka) Subscribe(r Receiver) {
+func consumePartitions(consumer sarama.Consumer, topic string) ([]sarama.PartitionConsumer, error) {
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]sarama.PartitionConsumer, 0, len(partitions))
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			for _, pc := range res {
+				pc.Close()
+			}
+			return nil, err
+		}
+		res = append(res, pc)
+	}
+	return res, nil
+}
+
+func (k *Kafka) Subscribe(r bus.Receiver) {
 	k.receiversMutex.Lock()
 	k.receivers[r] = struct{}{}
 	k.receiversMutex.Unlock()
 }
 
-func (k *Kafka) Unsubscribe(r Receiver) {
+func (k *Kafka) Unsubscribe(r bus.Receiver) {
 	k.receiversMutex.Lock()
 	delete(k.receivers, r)
 	k.receiversMutex.Unlock()
 }
 
-func (k *Kafka) Publish(data []byte) {
-	k.publish <- data
+// Messages with the same key go to the same partition, so they are received in
+// the order they were published. Messages without a key are spread over partitions.
+// The producer is safe for concurrent use, so every caller waits only for
+// the acknowledgement of its own message.
+func (k *Kafka) Publish(key string, data []byte) error {
+	msg := &sarama.ProducerMessage{
+		Topic: k.topic,
+	}
+	// A message without value is a tombstone, it deletes the key from a compacted topic
+	if data != nil {
+		msg.Value = sarama.ByteEncoder(data)
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	k.producerMutex.RLock()
+	defer k.producerMutex.RUnlock()
+	if k.closed {
+		return ErrStopped
+	}
+	_, _, err := k.producer.SendMessage(msg)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// Snapshot reads the topic from the beginning up to the latest message. It's meant for
+// log-compacted topics, other topics would return the latest message for every key
+// that is still retained.
+func (k *Kafka) Snapshot(ctx context.Context) ([]*bus.Message, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(k.brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(k.topic)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*bus.Message)
+	for _, partition := range partitions {
+		if err := k.readPartition(ctx, client, consumer, partition, latest); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*bus.Message, 0, len(latest))
+	for _, msg := range latest {
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (k *Kafka) readPartition(ctx context.Context, client sarama.Client, consumer sarama.Consumer, partition int32, latest map[string]*bus.Message) error {
+	oldest, err := client.GetOffset(k.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	// Offset of the message that will be published next
+	newest, err := client.GetOffset(k.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if oldest >= newest {
+		return nil
+	}
+
+	pc, err := consumer.ConsumePartition(k.topic, partition, oldest)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	for {
+		select {
+		case err := <-pc.Errors():
+			return err
+		case msg := <-pc.Messages():
+			if msg.Value == nil {
+				delete(latest, string(msg.Key))
+			} else {
+				latest[string(msg.Key)] = &bus.Message{
+					Key:  string(msg.Key),
+					Data: msg.Value,
+					Seq:  msg.Offset + 1,
+				}
+			}
+			// Compaction leaves gaps in offsets, but the last message is still at newest-1
+			if msg.Offset+1 >= newest {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (k *Kafka) Run(ctx context.Context) {
-	go k.consume(ctx)
-	k.produce(ctx)
+	for _, pc := range k.partitionConsumers {
+		k.wg.Add(1)
+		go k.consume(ctx, pc)
+	}
 }
 
 func (k *Kafka) Wait() {
@@ -85,30 +229,41 @@ func (k *Kafka) Wait() {
 }
 
 func (k *Kafka) Close() {
+	k.producerMutex.Lock()
+	k.closed = true
 	k.producer.Close()
-	k.partitionConsumer.Close()
+	k.producerMutex.Unlock()
+	for _, pc := range k.partitionConsumers {
+		pc.Close()
+	}
 	k.consumer.Close()
 }
 
-func (k *Kafka) consume(ctx context.Context) {
+func (k *Kafka) consume(ctx context.Context, pc sarama.PartitionConsumer) {
 	log.Printf("Start Kafka consumer loop for the topic %v", k.topic)
-	k.wg.Add(1)
 Loop:
 	for {
 		select {
-		case err := <-k.partitionConsumer.Errors():
+		case err := <-pc.Errors():
 			if err == nil {
 				log.Fatalf("Received nil message from Kafka, probably closed connection")
 			}
 			log.Println(err.Error())
-		case msg := <-k.partitionConsumer.Messages():
+		case msg := <-pc.Messages():
 			if msg == nil {
 				log.Fatalf("Received nil message from Kafka, probably closed connection")
 			}
 			log.Printf("Kafka receidved message %v from the topic %v", string(msg.Value), k.topic)
+			received := &bus.Message{
+				Key:  string(msg.Key),
+				Data: msg.Value,
+				// Offsets start from 0, but sequence numbers start from 1.
+				// Messages with the same key are in the same partition, so their offsets grow monotonically.
+				Seq: msg.Offset + 1,
+			}
 			k.receiversMutex.Lock()
 			for r := range k.receivers {
-				r.Receive(msg.Value)
+				r.Receive(received)
 			}
 			k.receiversMutex.Unlock()
 		case <-ctx.Done():
@@ -120,29 +275,6 @@ Loop:
 
 }
 
-func (k *Kafka) produce(ctx context.Context) {
-	log.Printf("Start Kafka producer loop for the topic %v", k.topic)
-	k.wg.Add(1)
-Loop:
-	for {
-		select {
-		case data := <-k.publish:
-			msg := &sarama.ProducerMessage{
-				Topic: k.topic,
-				Value: sarama.ByteEncoder(data),
-			}
-			_, _, err := k.producer.SendMessage(msg)
-			if err != nil {
-				log.Println(err.Error())
-			}
-		case <-ctx.Done():
-			break Loop
-		}
-	}
-	log.Printf("Done Kafka producer loop for the topic %v", k.topic)
-	k.wg.Done()
-}
-
 func connectConsumer(brokersUrl []string) (sarama.Consumer, error) {
 	config := sarama.NewConfig()
 	config.Consumer.Return.Errors = true
@@ -155,11 +287,12 @@ func connectConsumer(brokersUrl []string) (sarama.Consumer, error) {
 	return conn, nil
 }
 
-func connectProducer(brokersUrl []string) (sarama.SyncProducer, error) {
+func connectProducer(brokersUrl []string, acks sarama.RequiredAcks) (sarama.SyncProducer, error) {
 	config := sarama.NewConfig()
 	config.Producer.Return.Errors = true
 	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.RequiredAcks = acks
+	config.Producer.Partitioner = sarama.NewHashPartitioner
 
 	conn, err := sarama.NewSyncProducer(brokersUrl, config)
 	if err != nil {
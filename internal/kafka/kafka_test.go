@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ig0rmin/ich/internal/bus"
 	"github.com/ig0rmin/ich/internal/config"
 	"github.com/stretchr/testify/require"
 )
@@ -13,14 +14,17 @@ type MockSubscirber struct {
 	Received [][]byte
 }
 
-func (s *MockSubscirber) Receive(data []byte) error {
-	s.Received = append(s.Received, data)
+func (s *MockSubscirber) Receive(msg *bus.Message) error {
+	s.Received = append(s.Received, msg.Data)
 	return nil
 }
 
 func TestKafka(t *testing.T) {
 	var cfg Config
 	require.NoError(t, config.Load(&cfg))
+	if len(cfg.BootstrapServers) == 0 {
+		t.Skip("ICH_KAFKA_BOOTSTRAP_SERVERS is not set")
+	}
 
 	messages, err := NewKafka(cfg, "topic-messages")
 	require.NoError(t, err)
@@ -35,7 +39,7 @@ func TestKafka(t *testing.T) {
 	messages.Subscribe(&subscriber)
 
 	var data = []byte("hello from unit tests")
-	messages.Publish(data)
+	messages.Publish("", data)
 
 	// Give Kafka time to receive the message
 	time.Sleep(500 * time.Millisecond)
@@ -1,45 +1,110 @@
 package messages
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/ig0rmin/ich/internal/api"
-	"github.com/ig0rmin/ich/internal/kafka"
+	"github.com/ig0rmin/ich/internal/bus"
 )
 
+// Listeners get the whole message and its decoded payload
 type MessageListener interface {
-	ReceiveChatMessage(time.Time, *api.ChatMessage)
+	ReceiveChatMessage(*api.Msg, *api.ChatMessage)
+	ReceiveMessageEdited(*api.Msg, *api.MessageEdited)
+	ReceiveMessageDeleted(*api.Msg, *api.MessageDeleted)
+}
+
+type DirectMessageListener interface {
+	ReceiveDirectMessage(*api.Msg, *api.DirectMessage)
+}
+
+// Subscribe to AllRooms to receive messages from every room
+const AllRooms = ""
+
+// Number of recent chat messages remembered by Messages
+const recentSize = 4096
+
+// Recent chat message, or a deleted one if chatMsg is nil
+type recentMessage struct {
+	chatMsg *api.ChatMessage
 }
 
 type Messages struct {
-	messages *kafka.Kafka
+	messages bus.Bus
+
+	// Recent chat messages by ID. The history stores the messages with a delay,
+	// so the messages just sent are looked up here.
+	recent map[string]recentMessage
+	// IDs in the order they were added, the oldest one is replaced first
+	recentIDs   []string
+	recentNext  int
+	recentMutex sync.Mutex
 
-	listeners      map[MessageListener]struct{}
+	// Listeners of every room
+	listeners      map[string]map[MessageListener]struct{}
 	listenersMutex sync.Mutex
+
+	// Listeners of direct messages to and from every user
+	directListeners      map[string]map[DirectMessageListener]struct{}
+	directListenersMutex sync.Mutex
 }
 
-func NewMessages(messages *kafka.Kafka) (*Messages, error) {
+func NewMessages(messages bus.Bus) (*Messages, error) {
 	return &Messages{
-		messages:  messages,
-		listeners: make(map[MessageListener]struct{}),
+		messages:        messages,
+		recent:          make(map[string]recentMessage),
+		recentIDs:       make([]string, recentSize),
+		listeners:       make(map[string]map[MessageListener]struct{}),
+		directListeners: make(map[string]map[DirectMessageListener]struct{}),
 	}, nil
 }
 
-func (m *Messages) Subscribe(l MessageListener) {
+func (m *Messages) Subscribe(room string, l MessageListener) {
 	m.listenersMutex.Lock()
-	m.listeners[l] = struct{}{}
+	listeners, ok := m.listeners[room]
+	if !ok {
+		listeners = make(map[MessageListener]struct{})
+		m.listeners[room] = listeners
+	}
+	listeners[l] = struct{}{}
 	m.listenersMutex.Unlock()
 }
 
-func (m *Messages) Unsubscribe(l MessageListener) {
+func (m *Messages) Unsubscribe(room string, l MessageListener) {
 	m.listenersMutex.Lock()
-	delete(m.listeners, l)
+	delete(m.listeners[room], l)
+	if len(m.listeners[room]) == 0 {
+		delete(m.listeners, room)
+	}
 	m.listenersMutex.Unlock()
 }
 
+// SubscribeDirect subscribes the listener to direct messages sent to or by the user
+func (m *Messages) SubscribeDirect(userName string, l DirectMessageListener) {
+	m.directListenersMutex.Lock()
+	listeners, ok := m.directListeners[userName]
+	if !ok {
+		listeners = make(map[DirectMessageListener]struct{})
+		m.directListeners[userName] = listeners
+	}
+	listeners[l] = struct{}{}
+	m.directListenersMutex.Unlock()
+}
+
+func (m *Messages) UnsubscribeDirect(userName string, l DirectMessageListener) {
+	m.directListenersMutex.Lock()
+	delete(m.directListeners[userName], l)
+	if len(m.directListeners[userName]) == 0 {
+		delete(m.directListeners, userName)
+	}
+	m.directListenersMutex.Unlock()
+}
+
 func (m *Messages) Init() {
 	m.messages.Subscribe(m)
 }
@@ -48,38 +113,186 @@ func (m *Messages) Close() {
 	m.messages.Unsubscribe(m)
 }
 
-func (m *Messages) PostChatMessage(chatMsg *api.ChatMessage) error {
+// Chat messages are keyed by room to keep the order of the messages in the room.
+// PostChatMessage returns the published message once the bus accepted it.
+func (m *Messages) PostChatMessage(chatMsg *api.ChatMessage) (*api.Msg, error) {
 	msg := &api.Msg{
 		Type:   api.TypeChatMessage,
+		ID:     newMessageID(),
 		SentAt: time.Now(),
 		Msg:    chatMsg,
 	}
+	if err := m.publishMsg(chatMsg.Room, msg); err != nil {
+		return nil, err
+	}
+	m.remember(msg.ID, chatMsg)
+	return msg, nil
+}
+
+// Edits are keyed by room, so they are received after the message they edit
+func (m *Messages) PostMessageEdited(edited *api.MessageEdited) error {
+	return m.publishMsg(edited.Room, &api.Msg{
+		Type:   api.TypeMessageEdited,
+		SentAt: time.Now(),
+		Msg:    edited,
+	})
+}
+
+func (m *Messages) PostMessageDeleted(deleted *api.MessageDeleted) error {
+	return m.publishMsg(deleted.Room, &api.Msg{
+		Type:   api.TypeMessageDeleted,
+		SentAt: time.Now(),
+		Msg:    deleted,
+	})
+}
+
+// Direct messages are keyed by the pair of users to keep the order of the conversation
+func (m *Messages) PostDirectMessage(directMsg *api.DirectMessage) (*api.Msg, error) {
+	msg := &api.Msg{
+		Type:   api.TypeDirectMessage,
+		ID:     newMessageID(),
+		SentAt: time.Now(),
+		Msg:    directMsg,
+	}
+	if err := m.publishMsg(directMessageKey(directMsg.From, directMsg.To), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func newMessageID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+func directMessageKey(from, to string) string {
+	if from > to {
+		from, to = to, from
+	}
+	return "direct:" + from + ":" + to
+}
+
+func (m *Messages) publishMsg(key string, msg *api.Msg) error {
 	msgRaw, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	m.messages.Publish(msgRaw)
-	return nil
+	return m.messages.Publish(key, msgRaw)
 }
 
-func (u *Messages) Receive(data []byte) error {
-	var msg api.Msg
-	chatMsg := &api.ChatMessage{}
-	msg.Msg = chatMsg
-	if err := json.Unmarshal(data, &msg); err != nil {
+func (u *Messages) Receive(received *bus.Message) error {
+	var raw json.RawMessage
+	msg := &api.Msg{
+		Msg: &raw,
+	}
+	if err := json.Unmarshal(received.Data, msg); err != nil {
 		return nil
 	}
-	if msg.Type != api.TypeChatMessage {
+	msg.Seq = received.Seq
+	switch msg.Type {
+	case api.TypeChatMessage:
+		chatMsg := &api.ChatMessage{}
+		if err := json.Unmarshal(raw, chatMsg); err != nil {
+			return err
+		}
+		msg.Msg = chatMsg
+		u.remember(msg.ID, chatMsg)
+		u.notifyListeners(chatMsg.Room, func(l MessageListener) {
+			l.ReceiveChatMessage(msg, chatMsg)
+		})
+	case api.TypeMessageEdited:
+		edited := &api.MessageEdited{}
+		if err := json.Unmarshal(raw, edited); err != nil {
+			return err
+		}
+		msg.Msg = edited
+		u.notifyListeners(edited.Room, func(l MessageListener) {
+			l.ReceiveMessageEdited(msg, edited)
+		})
+	case api.TypeMessageDeleted:
+		deleted := &api.MessageDeleted{}
+		if err := json.Unmarshal(raw, deleted); err != nil {
+			return err
+		}
+		msg.Msg = deleted
+		u.remember(deleted.ID, nil)
+		u.notifyListeners(deleted.Room, func(l MessageListener) {
+			l.ReceiveMessageDeleted(msg, deleted)
+		})
+	case api.TypeDirectMessage:
+		directMsg := &api.DirectMessage{}
+		if err := json.Unmarshal(raw, directMsg); err != nil {
+			return err
+		}
+		msg.Msg = directMsg
+		u.notifyDirectListeners(msg, directMsg)
+	default:
 		return fmt.Errorf("unsupported message type: %v", msg.Type)
 	}
-	u.notifyListeners(msg.SentAt, chatMsg)
 	return nil
 }
 
-func (m *Messages) notifyListeners(sentAt time.Time, msg *api.ChatMessage) {
+// remember adds the chat message to the recent ones, nil marks the message deleted
+func (m *Messages) remember(id string, chatMsg *api.ChatMessage) {
+	if id == "" {
+		return
+	}
+	m.recentMutex.Lock()
+	defer m.recentMutex.Unlock()
+	if _, ok := m.recent[id]; !ok {
+		delete(m.recent, m.recentIDs[m.recentNext])
+		m.recentIDs[m.recentNext] = id
+		m.recentNext = (m.recentNext + 1) % len(m.recentIDs)
+	}
+	// The message is received after it was posted, and may be deleted by then
+	if prev, ok := m.recent[id]; ok && prev.chatMsg == nil {
+		return
+	}
+	if chatMsg != nil {
+		copied := *chatMsg
+		chatMsg = &copied
+	}
+	m.recent[id] = recentMessage{chatMsg: chatMsg}
+}
+
+// RecentChatMessage returns the chat message if it was posted or received recently.
+// ok is false if the message isn't among the recent ones, and the message is nil
+// if it was deleted.
+func (m *Messages) RecentChatMessage(id string) (chatMsg *api.ChatMessage, ok bool) {
+	m.recentMutex.Lock()
+	defer m.recentMutex.Unlock()
+	recent, ok := m.recent[id]
+	if !ok || recent.chatMsg == nil {
+		return nil, ok
+	}
+	res := *recent.chatMsg
+	return &res, true
+}
+
+func (m *Messages) notifyListeners(room string, notify func(MessageListener)) {
 	m.listenersMutex.Lock()
-	for l := range m.listeners {
-		l.ReceiveChatMessage(sentAt, msg)
+	for l := range m.listeners[room] {
+		notify(l)
+	}
+	for l := range m.listeners[AllRooms] {
+		notify(l)
 	}
 	m.listenersMutex.Unlock()
 }
+
+// Only the sender and the recipient get a direct message
+func (m *Messages) notifyDirectListeners(msg *api.Msg, directMsg *api.DirectMessage) {
+	m.directListenersMutex.Lock()
+	for l := range m.directListeners[directMsg.From] {
+		l.ReceiveDirectMessage(msg, directMsg)
+	}
+	if directMsg.To != directMsg.From {
+		for l := range m.directListeners[directMsg.To] {
+			l.ReceiveDirectMessage(msg, directMsg)
+		}
+	}
+	m.directListenersMutex.Unlock()
+}
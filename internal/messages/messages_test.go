@@ -2,26 +2,22 @@ package messages
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ig0rmin/ich/internal/api"
-	"github.com/ig0rmin/ich/internal/config"
-	"github.com/ig0rmin/ich/internal/kafka"
+	"github.com/ig0rmin/ich/internal/bus"
 	"github.com/stretchr/testify/require"
 )
 
 type MockServer struct {
-	topic    *kafka.Kafka
+	topic    *bus.Memory
 	messages *Messages
 }
 
 func NewMockServer(t *testing.T, ctx context.Context) *MockServer {
-	var cfg kafka.Config
-	require.NoError(t, config.Load(&cfg))
-
-	topic, err := kafka.NewKafka(cfg, "topic-messages")
-	require.NoError(t, err)
+	topic := bus.NewMemory()
 
 	go topic.Run(ctx)
 
@@ -44,10 +40,35 @@ func (m *MockServer) Close() {
 
 type MockMessageListener struct {
 	Received []api.ChatMessage
+	Msgs     []api.Msg
+	Edited   []api.MessageEdited
+	Deleted  []api.MessageDeleted
+	mutex    sync.Mutex
 }
 
-func (m *MockMessageListener) ReceiveChatMessage(sentAt time.Time, chatMsg *api.ChatMessage) {
+func (m *MockMessageListener) ReceiveChatMessage(msg *api.Msg, chatMsg *api.ChatMessage) {
+	m.mutex.Lock()
 	m.Received = append(m.Received, *chatMsg)
+	m.Msgs = append(m.Msgs, *msg)
+	m.mutex.Unlock()
+}
+
+func (m *MockMessageListener) ReceiveMessageEdited(msg *api.Msg, edited *api.MessageEdited) {
+	m.mutex.Lock()
+	m.Edited = append(m.Edited, *edited)
+	m.mutex.Unlock()
+}
+
+func (m *MockMessageListener) ReceiveMessageDeleted(msg *api.Msg, deleted *api.MessageDeleted) {
+	m.mutex.Lock()
+	m.Deleted = append(m.Deleted, *deleted)
+	m.mutex.Unlock()
+}
+
+func (m *MockMessageListener) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.Received)
 }
 
 func TestMessages(t *testing.T) {
@@ -59,18 +80,181 @@ func TestMessages(t *testing.T) {
 	server.messages.Init()
 
 	var listener MockMessageListener
-	server.messages.Subscribe(&listener)
+	server.messages.Subscribe("lobby", &listener)
+
+	var otherRoomListener MockMessageListener
+	server.messages.Subscribe("other", &otherRoomListener)
+
+	var allRoomsListener MockMessageListener
+	server.messages.Subscribe(AllRooms, &allRoomsListener)
 
 	msg := &api.ChatMessage{
+		Room: "lobby",
 		From: "Patrick",
 		Text: "Hello!",
 	}
 
 	server.messages.PostChatMessage(msg)
 
-	// Let Kafka time to process messages
-	time.Sleep(500 * time.Millisecond)
+	require.Eventually(t, func() bool {
+		return listener.Len() == 1 && allRoomsListener.Len() == 1
+	}, time.Second, 10*time.Millisecond)
 
 	require.Equal(t, 1, len(listener.Received))
 	require.Contains(t, listener.Received, *msg)
+
+	require.Equal(t, 0, len(otherRoomListener.Received))
+
+	require.Equal(t, 1, len(allRoomsListener.Received))
+	require.Contains(t, allRoomsListener.Received, *msg)
+}
+
+type MockDirectMessageListener struct {
+	Received []api.DirectMessage
+	mutex    sync.Mutex
+}
+
+func (m *MockDirectMessageListener) ReceiveDirectMessage(msg *api.Msg, directMsg *api.DirectMessage) {
+	m.mutex.Lock()
+	m.Received = append(m.Received, *directMsg)
+	m.mutex.Unlock()
+}
+
+func (m *MockDirectMessageListener) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.Received)
+}
+
+func TestDirectMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewMockServer(t, ctx)
+	defer server.Close()
+	defer cancel()
+
+	var patrick, spongebob, squidward MockDirectMessageListener
+	server.messages.SubscribeDirect("Patrick", &patrick)
+	server.messages.SubscribeDirect("Spongebob", &spongebob)
+	server.messages.SubscribeDirect("Squidward", &squidward)
+
+	msg := &api.DirectMessage{
+		From: "Patrick",
+		To:   "Spongebob",
+		Text: "Hello!",
+	}
+
+	server.messages.PostDirectMessage(msg)
+
+	require.Eventually(t, func() bool {
+		return patrick.Len() == 1 && spongebob.Len() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, []api.DirectMessage{*msg}, patrick.Received)
+	require.Equal(t, []api.DirectMessage{*msg}, spongebob.Received)
+	require.Equal(t, 0, len(squidward.Received))
+}
+
+func TestMessageIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewMockServer(t, ctx)
+	defer server.Close()
+	defer cancel()
+
+	var listener MockMessageListener
+	server.messages.Subscribe("lobby", &listener)
+
+	for _, text := range []string{"Hello!", "How are you?"} {
+		server.messages.PostChatMessage(&api.ChatMessage{
+			Room: "lobby",
+			From: "Patrick",
+			Text: text,
+		})
+	}
+
+	require.Eventually(t, func() bool {
+		return listener.Len() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	first, second := listener.Msgs[0], listener.Msgs[1]
+	require.NotEmpty(t, first.ID)
+	require.NotEmpty(t, second.ID)
+	require.NotEqual(t, first.ID, second.ID)
+	require.Greater(t, first.Seq, int64(0))
+	require.Greater(t, second.Seq, first.Seq)
+}
+
+func TestMessageChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewMockServer(t, ctx)
+	defer server.Close()
+	defer cancel()
+
+	var listener, otherRoomListener MockMessageListener
+	server.messages.Subscribe("lobby", &listener)
+	server.messages.Subscribe("other", &otherRoomListener)
+
+	edited := &api.MessageEdited{
+		ID:       "1",
+		Room:     "lobby",
+		Text:     "Hello, world!",
+		EditedBy: "Patrick",
+	}
+	deleted := &api.MessageDeleted{
+		ID:        "2",
+		Room:      "lobby",
+		DeletedBy: "Patrick",
+	}
+	server.messages.PostMessageEdited(edited)
+	server.messages.PostMessageDeleted(deleted)
+
+	require.Eventually(t, func() bool {
+		listener.mutex.Lock()
+		defer listener.mutex.Unlock()
+		return len(listener.Edited) == 1 && len(listener.Deleted) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, *edited, listener.Edited[0])
+	require.Equal(t, *deleted, listener.Deleted[0])
+	require.Equal(t, 0, len(otherRoomListener.Edited))
+	require.Equal(t, 0, len(otherRoomListener.Deleted))
+}
+
+func TestRecentChatMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewMockServer(t, ctx)
+	defer server.Close()
+	defer cancel()
+
+	// The message is known as soon as it's posted, before anyone received it
+	chatMsg := &api.ChatMessage{
+		Room: "lobby",
+		From: "Patrick",
+		Text: "Hello!",
+	}
+	msg, err := server.messages.PostChatMessage(chatMsg)
+	require.NoError(t, err)
+	recent, ok := server.messages.RecentChatMessage(msg.ID)
+	require.True(t, ok)
+	require.Equal(t, chatMsg, recent)
+
+	_, ok = server.messages.RecentChatMessage("unknown")
+	require.False(t, ok)
+
+	// Deleted messages are remembered as deleted
+	require.NoError(t, server.messages.PostMessageDeleted(&api.MessageDeleted{
+		ID:        msg.ID,
+		Room:      "lobby",
+		DeletedBy: "Patrick",
+	}))
+	require.Eventually(t, func() bool {
+		recent, ok := server.messages.RecentChatMessage(msg.ID)
+		return ok && recent == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Only the most recent messages are remembered
+	for i := 0; i < recentSize; i++ {
+		server.messages.remember(newMessageID(), chatMsg)
+	}
+	_, ok = server.messages.RecentChatMessage(msg.ID)
+	require.False(t, ok)
 }
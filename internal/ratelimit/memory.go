@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// The bucket is full again at this time
+	fullAt time.Time
+}
+
+// MemoryStore keeps the buckets in process, so the limits apply to every
+// server instance separately
+type MemoryStore struct {
+	buckets map[string]*bucket
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), updatedAt: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	b.fullAt = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return true, nil
+}
+
+func (m *MemoryStore) Cleanup(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	for key, b := range m.buckets {
+		if b.fullAt.Before(now) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
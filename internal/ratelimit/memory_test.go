@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	limiter := NewLimiter(store, "messages", 1, 3)
+
+	// The burst is allowed at once
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.Allow(ctx, "Patrick"))
+	}
+	require.False(t, limiter.Allow(ctx, "Patrick"))
+
+	// Other users have their own buckets
+	require.True(t, limiter.Allow(ctx, "Spongebob"))
+
+	// The bucket refills with the rate
+	now = now.Add(1500 * time.Millisecond)
+	require.True(t, limiter.Allow(ctx, "Patrick"))
+	require.False(t, limiter.Allow(ctx, "Patrick"))
+
+	// And never holds more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.Allow(ctx, "Patrick"))
+	}
+	require.False(t, limiter.Allow(ctx, "Patrick"))
+
+	// Zero rate disables the limit
+	unlimited := NewLimiter(store, "logins", 0, 0)
+	require.True(t, unlimited.Allow(ctx, "127.0.0.1"))
+}
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	limiter := NewLimiter(store, "messages", 1, 3)
+	require.True(t, limiter.Allow(ctx, "Patrick"))
+	require.True(t, limiter.Allow(ctx, "Patrick"))
+	require.True(t, limiter.Allow(ctx, "Spongebob"))
+
+	// Spongebob's bucket is full in a second, Patrick's in two
+	now = now.Add(1500 * time.Millisecond)
+	require.NoError(t, store.Cleanup(ctx))
+	require.Len(t, store.buckets, 1)
+	require.Contains(t, store.buckets, "messages:Patrick")
+
+	// A removed bucket is the same as a full one
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.Allow(ctx, "Spongebob"))
+	}
+	require.False(t, limiter.Allow(ctx, "Spongebob"))
+
+	now = now.Add(time.Hour)
+	require.NoError(t, store.Cleanup(ctx))
+	require.Empty(t, store.buckets)
+}
+
+func TestConfig(t *testing.T) {
+	cfg := Config{
+		MessagesRate:  2,
+		MessagesBurst: 10,
+		// Disabled limits don't need a burst
+		LoginsRate: 0,
+	}
+	require.NoError(t, cfg.Validate())
+
+	cfg.ConnectionsRate = 0.2
+	require.Error(t, cfg.Validate())
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits are token buckets: a bucket holds up to Burst tokens and gets Rate tokens
+// per second, every action takes a token. Rate 0 disables the limit.
+type Config struct {
+	// Chat and direct messages, edits and deletes per user
+	MessagesRate  float64 `env:"ICH_RATE_MESSAGES, default=2"`
+	MessagesBurst int     `env:"ICH_RATE_MESSAGES_BURST, default=10"`
+	// Websocket connections per user
+	ConnectionsRate  float64 `env:"ICH_RATE_CONNECTIONS, default=0.2"`
+	ConnectionsBurst int     `env:"ICH_RATE_CONNECTIONS_BURST, default=10"`
+	// Websocket connections without credentials per IP, they are upgraded
+	// before the user is known
+	AnonymousConnectionsRate  float64 `env:"ICH_RATE_ANONYMOUS_CONNECTIONS, default=1"`
+	AnonymousConnectionsBurst int     `env:"ICH_RATE_ANONYMOUS_CONNECTIONS_BURST, default=20"`
+	// Login attempts per IP
+	LoginsRate  float64 `env:"ICH_RATE_LOGINS, default=0.1"`
+	LoginsBurst int     `env:"ICH_RATE_LOGINS_BURST, default=5"`
+	// How often the buckets that refilled are removed from the store
+	CleanupInterval time.Duration `env:"ICH_RATE_CLEANUP_INTERVAL, default=1m"`
+}
+
+// Validate checks the config once on start. A bucket that can't hold a token
+// would reject every action, so the limits that are enabled need a burst.
+func (cfg *Config) Validate() error {
+	limits := []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"messages", cfg.MessagesRate, cfg.MessagesBurst},
+		{"connections", cfg.ConnectionsRate, cfg.ConnectionsBurst},
+		{"anonymous connections", cfg.AnonymousConnectionsRate, cfg.AnonymousConnectionsBurst},
+		{"logins", cfg.LoginsRate, cfg.LoginsBurst},
+	}
+	for _, l := range limits {
+		if l.rate > 0 && l.burst < 1 {
+			return fmt.Errorf("%v rate limit burst must be at least 1", l.name)
+		}
+	}
+	return nil
+}
+
+// Store keeps the buckets. Server instances share the buckets through the store,
+// so the limits apply to the whole cluster.
+type Store interface {
+	// Take takes a token from the bucket, it returns false if the bucket is empty
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, error)
+	// Cleanup removes the buckets that are full again, they are the same as the missing ones
+	Cleanup(ctx context.Context) error
+}
+
+// Every limited action waits for the store, if the store is slow the action
+// is allowed after this time
+const storeTimeout = time.Second
+
+type Limiter struct {
+	store Store
+	name  string
+	rate  float64
+	burst int
+}
+
+func NewLimiter(store Store, name string, rate float64, burst int) *Limiter {
+	return &Limiter{
+		store: store,
+		name:  name,
+		rate:  rate,
+		burst: burst,
+	}
+}
+
+// Allow returns false if the action identified by the key exceeds the limit.
+// The action is allowed if the store fails, so the chat keeps working.
+func (l *Limiter) Allow(ctx context.Context, key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	ok, err := l.store.Take(ctx, l.name+":"+key, l.rate, l.burst)
+	if err != nil {
+		log.Printf("Can't check %v rate limit: %v", l.name, err)
+		return true
+	}
+	return ok
+}
+
+// Cleaner removes the buckets that refilled, so the store doesn't keep
+// a bucket for every user and IP ever limited
+type Cleaner struct {
+	store    Store
+	interval time.Duration
+
+	wg *sync.WaitGroup
+}
+
+func NewCleaner(store Store, cfg Config) (*Cleaner, error) {
+	if cfg.CleanupInterval <= 0 {
+		return nil, errors.New("rate limit cleanup interval must be positive")
+	}
+	return &Cleaner{
+		store:    store,
+		interval: cfg.CleanupInterval,
+		wg:       &sync.WaitGroup{},
+	}, nil
+}
+
+func (c *Cleaner) Run(ctx context.Context) {
+	c.wg.Add(1)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+Loop:
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.store.Cleanup(ctx); err != nil {
+				log.Printf("Can't remove rate limit buckets: %v", err)
+			}
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	c.wg.Done()
+}
+
+func (c *Cleaner) Wait() {
+	c.wg.Wait()
+}
+
+// ByIP limits the requests from every client IP
+func ByIP(l *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.Allow(c.Request.Context(), c.ClientIP()) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Repository keeps the buckets in the database shared by all the server instances
+type Repository struct {
+	db *sql.DB
+}
+
+var _ Store = (*Repository)(nil)
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// Take refills the bucket and takes a token in one statement, so concurrent
+// requests to different server instances can't take the same token.
+// The bucket isn't updated when it's empty.
+func (r *Repository) Take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	query := `INSERT INTO rate_limits AS r (key, tokens, updated_at, full_at)
+		VALUES ($1, $2::float8 - 1, now(), now() + make_interval(secs => 1 / $3::float8))
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($2::float8, r.tokens + EXTRACT(EPOCH FROM now() - r.updated_at)::float8 * $3::float8) - 1,
+			updated_at = now(),
+			full_at = now() + make_interval(secs => ($2::float8 + 1
+				- LEAST($2::float8, r.tokens + EXTRACT(EPOCH FROM now() - r.updated_at)::float8 * $3::float8)) / $3::float8)
+		WHERE LEAST($2::float8, r.tokens + EXTRACT(EPOCH FROM now() - r.updated_at)::float8 * $3::float8) >= 1
+		RETURNING tokens`
+	var tokens float64
+	err := r.db.QueryRowContext(ctx, query, key, burst, rate).Scan(&tokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *Repository) Cleanup(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE full_at < now()")
+	return err
+}
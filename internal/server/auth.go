@@ -1,15 +1,49 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/auth"
+	"github.com/ig0rmin/ich/internal/tickets"
 	"github.com/ig0rmin/ich/internal/user"
+	"github.com/ig0rmin/ich/internal/ws"
 )
 
-func authMiddleware(serverSecret string) gin.HandlerFunc {
+// authError is a rejection of the request, status is the HTTP status of the response
+type authError struct {
+	status int
+	text   string
+}
+
+func (e *authError) Error() string {
+	return e.text
+}
+
+var (
+	errUnauthorized  = &authError{http.StatusUnauthorized, "Unauthorized"}
+	errTokenRevoked  = &authError{http.StatusUnauthorized, "Token is revoked"}
+	errInvalidTicket = &authError{http.StatusUnauthorized, "Invalid ticket"}
+	errCheckToken    = &authError{http.StatusInternalServerError, "Can't check the token"}
+)
+
+// authenticator accepts access tokens that are signed by the known keys and not
+// expired, and the tickets issued for such tokens. The sessions of the tokens are
+// also checked for revocation unless they are issued by an external identity provider.
+type authenticator struct {
+	keys *auth.Keys
+	// Nil if the tokens are issued by an external identity provider
+	tokens  *user.Repository
+	tickets *tickets.Tickets
+}
+
+// middleware accepts the access token in the Authorization header
+func (a *authenticator) middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
 		if tokenString == "" {
@@ -22,31 +56,132 @@ func authMiddleware(serverSecret string) gin.HandlerFunc {
 		if !strings.HasPrefix(tokenString, Bearer) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authroization header format"})
 			c.Abort()
+			return
 		}
 		tokenString = strings.TrimPrefix(tokenString, Bearer)
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if token.Method.Alg() != "HS256" {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(serverSecret), nil
-		})
+		if err := a.authenticateToken(c, tokenString); err != nil {
+			abortWithAuthError(c, err)
+			return
+		}
 
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			c.Abort()
+		c.Next()
+	}
+}
+
+// wsMiddleware lets browsers open websockets, they can't set the Authorization header.
+// The token may be passed as a subprotocol or in the access_token query parameter,
+// and the ticket in the ticket query parameter. The request without them passes
+// unauthenticated, then the client must send the auth message first.
+func (a *authenticator) wsMiddleware() gin.HandlerFunc {
+	header := a.middleware()
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			header(c)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			c.Set(user.UserNameKey, claims[user.UserNameKey])
-			c.Set(user.UserIDKey, claims[user.UserIDKey])
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad JWT token"})
-			c.Abort()
+		var err error
+		if token := subprotocolToken(c.Request); token != "" {
+			err = a.authenticateToken(c, token)
+		} else if token := c.Query("access_token"); token != "" {
+			err = a.authenticateToken(c, token)
+		} else if ticket := c.Query("ticket"); ticket != "" {
+			err = a.authenticateTicket(c, ticket)
+		}
+		if err != nil {
+			abortWithAuthError(c, err)
 			return
 		}
 
 		c.Next()
 	}
 }
+
+// authenticateMessage authenticates the websocket by the auth message
+func (a *authenticator) authenticateMessage(c *gin.Context, msg *api.Auth) error {
+	switch {
+	case msg.Token != "":
+		return a.authenticateToken(c, msg.Token)
+	case msg.Ticket != "":
+		return a.authenticateTicket(c, msg.Ticket)
+	}
+	return errUnauthorized
+}
+
+func (a *authenticator) authenticateToken(c *gin.Context, tokenString string) error {
+	claims, err := a.keys.Parse(tokenString)
+	if err != nil {
+		return errUnauthorized
+	}
+	userName, userID, err := a.keys.Identity(claims)
+	if err != nil {
+		return errUnauthorized
+	}
+
+	var sessionID string
+	if a.tokens != nil {
+		// Tokens without a session can't be revoked
+		sessionID, _ = claims[user.SessionIDKey].(string)
+		if sessionID == "" {
+			return errUnauthorized
+		}
+		if err := a.checkRevoked(c.Request.Context(), sessionID); err != nil {
+			return err
+		}
+	}
+
+	c.Set(user.UserNameKey, userName)
+	c.Set(user.UserIDKey, userID)
+	c.Set(user.SessionIDKey, sessionID)
+	return nil
+}
+
+func (a *authenticator) authenticateTicket(c *gin.Context, id string) error {
+	ticket, err := a.tickets.Redeem(c.Request.Context(), id)
+	if errors.Is(err, tickets.ErrInvalidTicket) {
+		return errInvalidTicket
+	}
+	if err != nil {
+		return errCheckToken
+	}
+	// The session might be revoked after the ticket was issued
+	if a.tokens != nil {
+		if err := a.checkRevoked(c.Request.Context(), ticket.SessionID); err != nil {
+			return err
+		}
+	}
+
+	c.Set(user.UserNameKey, ticket.UserName)
+	c.Set(user.UserIDKey, ticket.UserID)
+	c.Set(user.SessionIDKey, ticket.SessionID)
+	return nil
+}
+
+func (a *authenticator) checkRevoked(ctx context.Context, sessionID string) error {
+	revoked, err := a.tokens.IsSessionRevoked(ctx, sessionID)
+	if err != nil {
+		return errCheckToken
+	}
+	if revoked {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// subprotocolToken returns the token passed as the "bearer.<token>" subprotocol
+func subprotocolToken(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, ws.TokenSubprotocolPrefix); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+func abortWithAuthError(c *gin.Context, err error) {
+	authErr := errUnauthorized
+	errors.As(err, &authErr)
+	c.JSON(authErr.status, gin.H{"error": authErr.text})
+	c.Abort()
+}
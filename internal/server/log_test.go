@@ -0,0 +1,15 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactQuery(t *testing.T) {
+	require.Equal(t, "/join", redactQuery("/join"))
+	require.Equal(t, "/join?room=lobby", redactQuery("/join?room=lobby"))
+	require.Equal(t, "/join?access_token=REDACTED&room=lobby", redactQuery("/join?room=lobby&access_token=eyJhbGciOiJIUzI1NiJ9.e30.x"))
+	require.Equal(t, "/join?ticket=REDACTED", redactQuery("/join?ticket=q1VBhfa0q2n1x0n3"))
+	require.Equal(t, "/join?REDACTED", redactQuery("/join?ticket=%zz"))
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -11,9 +13,17 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ig0rmin/ich/internal/auth"
+	"github.com/ig0rmin/ich/internal/bus"
+	"github.com/ig0rmin/ich/internal/cors"
 	"github.com/ig0rmin/ich/internal/db"
+	"github.com/ig0rmin/ich/internal/history"
 	"github.com/ig0rmin/ich/internal/kafka"
 	"github.com/ig0rmin/ich/internal/messages"
+	"github.com/ig0rmin/ich/internal/ratelimit"
+	"github.com/ig0rmin/ich/internal/sessions"
+	"github.com/ig0rmin/ich/internal/tickets"
+	"github.com/ig0rmin/ich/internal/typing"
 	"github.com/ig0rmin/ich/internal/user"
 	"github.com/ig0rmin/ich/internal/users"
 	"github.com/ig0rmin/ich/internal/ws"
@@ -21,20 +31,54 @@ import (
 
 type Config struct {
 	// Port to listen
-	Port         string `env:"ICH_PORT, default=8080"`
-	ServerSecret string `env:"ICH_SERVER_SECRET, required"`
-
-	DB    db.Config
-	Kafka kafka.Config
+	Port string `env:"ICH_PORT, default=8080"`
+	// Secret of HS256 tokens, required unless the tokens are signed with JWT.SigningKey
+	ServerSecret string `env:"ICH_SERVER_SECRET"`
+	// Message bus connecting server instances: "kafka" or "memory".
+	// The memory bus doesn't connect to other instances, so it's only
+	// suitable for running a single instance.
+	Bus string `env:"ICH_BUS, default=kafka"`
+	// Users can be created and log in to the server. Disable it to accept only the
+	// tokens of an external identity provider. Then the database is optional,
+	// without it there is no chat history and the rate limits apply to every
+	// instance separately.
+	UserManagement bool `env:"ICH_USER_MANAGEMENT, default=true"`
+	// Addresses or CIDRs of the reverse proxies allowed to set X-Forwarded-For
+	// and X-Forwarded-Proto, separated by ';'. The client IP limits the logins,
+	// so by default no proxy is trusted and the client IP is the address of
+	// the connection.
+	TrustedProxies []string `env:"ICH_TRUSTED_PROXIES, delimiter=;"`
+
+	DB        db.Config
+	Kafka     kafka.Config
+	History   history.Config
+	Users     users.Config
+	Typing    typing.Config
+	Auth      user.Config
+	JWT       auth.Config
+	WS        ws.Config
+	RateLimit ratelimit.Config
+	Tickets   tickets.Config
+	CORS      cors.Config
 }
 
 type Server struct {
 	db       *sql.DB
-	messages *kafka.Kafka
-	users    *kafka.Kafka
-
-	userMgr *users.UserManager
-	msg     *messages.Messages
+	messages bus.Bus
+	users    bus.Compacted
+	events   bus.Bus
+	// Revoked sessions must reach every server, unlike the ephemeral events
+	revocations bus.Bus
+
+	keys     *auth.Keys
+	userMgr  *users.UserManager
+	msg      *messages.Messages
+	typing   *typing.Typing
+	sessions *sessions.Sessions
+	history  *history.Repository
+	sink     *history.Sink
+	limits   *ratelimit.Cleaner
+	ws       *ws.Handler
 
 	server *http.Server
 	router *gin.Engine
@@ -44,30 +88,50 @@ func NewServer(cfg *Config) (*Server, error) {
 	var err error
 	s := &Server{}
 
-	s.db, err = db.Connect(&cfg.DB)
-	if err != nil {
+	if err := cfg.WS.Validate(); err != nil {
 		return nil, err
 	}
-	err = s.db.Ping()
-	if err != nil {
+	if err := cfg.RateLimit.Validate(); err != nil {
 		return nil, err
 	}
-	log.Println("Connection to DB established")
 
-	if err := db.Migrate(&cfg.DB); err != nil {
+	s.keys, err = auth.NewKeys(cfg.JWT, cfg.ServerSecret)
+	if err != nil {
 		return nil, err
 	}
 
-	s.messages, err = kafka.NewKafka(cfg.Kafka, "topic-messages")
+	if cfg.UserManagement && !s.keys.CanSign() {
+		return nil, errors.New("user management requires the server secret or the signing key")
+	}
+
+	if cfg.DB.Configured() {
+		if err := s.connectDB(&cfg.DB); err != nil {
+			return nil, err
+		}
+	} else if cfg.UserManagement {
+		return nil, errors.New("user management requires the database")
+	} else {
+		log.Println("Running without DB, the chat history is disabled")
+	}
+
+	s.messages, err = newBus(cfg, "topic-messages", kafka.NewKafka)
+	if err != nil {
+		return nil, err
+	}
+	s.users, err = newCompactedBus(cfg, "topic-presence")
+	if err != nil {
+		return nil, err
+	}
+	s.events, err = newBus(cfg, "topic-events", kafka.NewEphemeralKafka)
 	if err != nil {
 		return nil, err
 	}
-	s.users, err = kafka.NewKafka(cfg.Kafka, "topic-users")
+	s.revocations, err = newBus(cfg, "topic-sessions", kafka.NewKafka)
 	if err != nil {
 		return nil, err
 	}
 
-	s.userMgr, err = users.NewUserManager(s.users)
+	s.userMgr, err = users.NewUserManager(s.users, cfg.Users)
 	if err != nil {
 		return nil, err
 	}
@@ -77,20 +141,86 @@ func NewServer(cfg *Config) (*Server, error) {
 		return nil, err
 	}
 
-	s.router = gin.Default()
+	s.typing, err = typing.NewTyping(s.events, cfg.Typing)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions = sessions.NewSessions(s.revocations)
+
+	// Limits and tickets are shared by all the server instances through the database
+	var limits ratelimit.Store = ratelimit.NewMemoryStore()
+	var ticketStore tickets.Store = tickets.NewMemoryStore()
+	if s.db != nil {
+		s.history = history.NewRepository(s.db)
+		s.sink = history.NewSink(s.history, s.msg)
+		limits = ratelimit.NewRepository(s.db)
+		ticketStore = tickets.NewRepository(s.db)
+	}
+	rl := cfg.RateLimit
+	s.limits, err = ratelimit.NewCleaner(limits, rl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens of an external identity provider can't be revoked here
+	var userRepo *user.Repository
+	if cfg.UserManagement {
+		userRepo = user.NewRepository(s.db)
+	}
+	wsTickets := tickets.NewTickets(ticketStore, cfg.Tickets)
+	authn := &authenticator{
+		keys:    s.keys,
+		tokens:  userRepo,
+		tickets: wsTickets,
+	}
+
+	origins, err := cors.NewOrigins(cfg.CORS, cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	// The access log doesn't show the tokens passed in the URL
+	s.router = gin.New()
+	if err := s.router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	s.router.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery(), origins.Middleware())
+
+	s.ws = ws.NewHandler(cfg.WS, cfg.History, ws.Deps{
+		UserMgr:         s.userMgr,
+		Messages:        s.msg,
+		Typing:          s.typing,
+		History:         s.history,
+		Sink:            s.sink,
+		ConnLimiter:     ratelimit.NewLimiter(limits, "connections", rl.ConnectionsRate, rl.ConnectionsBurst),
+		MsgLimiter:      ratelimit.NewLimiter(limits, "messages", rl.MessagesRate, rl.MessagesBurst),
+		AnonConnLimiter: ratelimit.NewLimiter(limits, "anonymous-connections", rl.AnonymousConnectionsRate, rl.AnonymousConnectionsBurst),
+		Authenticate:    authn.authenticateMessage,
+		CheckOrigin:     origins.CheckOrigin,
+	})
+	s.sessions.Subscribe(s.ws)
 
 	// Set up routes
 	s.router.GET("/status", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"status": "ok",
+			"status":           "ok",
+			"dropped_messages": s.ws.DroppedMessages(),
 		})
 	})
 
-	user.NewHandler(
-		user.NewService(user.NewRepository(s.db), cfg.ServerSecret),
-	).Route(s.router)
+	var userHandler *user.Handler
+	if cfg.UserManagement {
+		userHandler = user.NewHandler(
+			user.NewService(userRepo, s.keys, cfg.Auth, s.sessions),
+			ratelimit.NewLimiter(limits, "logins", rl.LoginsRate, rl.LoginsBurst),
+		)
+		userHandler.Route(s.router)
+		if s.keys.Issuing() {
+			auth.NewHandler(s.keys).Route(s.router)
+		}
+	}
 
-	authenticated := s.router.Group("", authMiddleware(cfg.ServerSecret))
+	authenticated := s.router.Group("", authn.middleware())
 	authenticated.GET("/auth-test", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			user.UserNameKey: c.GetString(user.UserNameKey),
@@ -98,7 +228,14 @@ func NewServer(cfg *Config) (*Server, error) {
 		})
 	})
 
-	ws.NewHandler(s.userMgr, s.msg).Route(authenticated)
+	if userHandler != nil {
+		userHandler.RouteAuthenticated(authenticated)
+	}
+	tickets.NewHandler(wsTickets).Route(authenticated)
+	s.ws.Route(s.router.Group("", authn.wsMiddleware()))
+	if s.history != nil {
+		history.NewHandler(s.history).Route(authenticated)
+	}
 
 	s.server = &http.Server{
 		Addr:    "0.0.0.0:" + cfg.Port,
@@ -108,15 +245,65 @@ func NewServer(cfg *Config) (*Server, error) {
 	return s, nil
 }
 
+func newBus(cfg *Config, topic string, newKafka func(kafka.Config, string) (*kafka.Kafka, error)) (bus.Bus, error) {
+	switch cfg.Bus {
+	case "kafka":
+		k, err := newKafka(cfg.Kafka, topic)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	case "memory":
+		return bus.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported bus: %v", cfg.Bus)
+	}
+}
+
+// The Kafka topic must be created with cleanup.policy=compact
+func newCompactedBus(cfg *Config, topic string) (bus.Compacted, error) {
+	switch cfg.Bus {
+	case "kafka":
+		return kafka.NewKafka(cfg.Kafka, topic)
+	case "memory":
+		return bus.NewCompactedMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported bus: %v", cfg.Bus)
+	}
+}
+
+// The server doesn't start if it can't read the users online for this long
+const presenceInitTimeout = 30 * time.Second
+
 func (s *Server) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	go s.messages.Run(ctx)
 	go s.users.Run(ctx)
-
-	s.userMgr.Init()
+	go s.events.Run(ctx)
+	go s.revocations.Run(ctx)
+	if s.sink != nil {
+		go s.sink.Run(ctx)
+	}
+	go s.typing.Run(ctx)
+	go s.userMgr.Run(ctx)
+	go s.keys.Run(ctx)
+	go s.limits.Run(ctx)
+
+	// Users connect only after the server knows who is online
+	initCtx, initCancel := context.WithTimeout(ctx, presenceInitTimeout)
+	err := s.userMgr.Init(initCtx)
+	initCancel()
+	if err != nil {
+		log.Fatalf("Can't load users online: %v", err)
+	}
 	s.msg.Init()
+	s.typing.Init()
+	s.sessions.Init()
+	if s.sink != nil {
+		s.sink.Init()
+	}
 
 	go func() {
 		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -128,13 +315,26 @@ func (s *Server) Run() {
 
 	log.Println("Http server done")
 
-	// Stop Kafka
+	// The websocket clients left, remove the rest of the users if any
+	s.userMgr.Leave()
+
+	// Stop the message bus
 	cancel()
 
 	s.messages.Wait()
 	s.users.Wait()
+	s.events.Wait()
+	s.revocations.Wait()
+
+	log.Println("Message bus done")
 
-	log.Println("Kafka done")
+	if s.sink != nil {
+		s.sink.Wait()
+	}
+	s.typing.Wait()
+	s.userMgr.Wait()
+	s.keys.Wait()
+	s.limits.Wait()
 }
 
 func (s *Server) waitForInterrupt() {
@@ -147,14 +347,41 @@ func (s *Server) waitForInterrupt() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Shutdown doesn't wait for websocket connections, so they are drained separately
 	if err := s.server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server Shutdown Failed: %+v", err)
 	}
+	if err := s.ws.Drain(ctx); err != nil {
+		log.Printf("Websocket clients didn't leave in time: %v", err)
+	}
 }
 
 func (s *Server) Close() {
-	s.db.Close()
+	if s.db != nil {
+		s.db.Close()
+	}
 	s.messages.Close()
 	s.users.Close()
+	s.events.Close()
+	s.revocations.Close()
 	s.msg.Close()
+	s.typing.Close()
+	s.sessions.Close()
+	if s.sink != nil {
+		s.sink.Close()
+	}
+}
+
+func (s *Server) connectDB(cfg *db.Config) error {
+	var err error
+	s.db, err = db.Connect(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+	log.Println("Connection to DB established")
+
+	return db.Migrate(cfg)
 }
@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/bus"
+)
+
+type SessionListener interface {
+	ReceiveSessionRevoked(*api.SessionRevoked)
+}
+
+// Sessions tells all the servers about the revoked login sessions,
+// so they can disconnect the websockets opened with them. A lost
+// revocation leaves the websockets open, so the bus must be reliable.
+type Sessions struct {
+	revocations bus.Bus
+
+	listeners      map[SessionListener]struct{}
+	listenersMutex sync.Mutex
+}
+
+func NewSessions(revocations bus.Bus) *Sessions {
+	return &Sessions{
+		revocations: revocations,
+		listeners:   make(map[SessionListener]struct{}),
+	}
+}
+
+func (s *Sessions) Init() {
+	s.revocations.Subscribe(s)
+}
+
+func (s *Sessions) Close() {
+	s.revocations.Unsubscribe(s)
+}
+
+func (s *Sessions) Subscribe(l SessionListener) {
+	s.listenersMutex.Lock()
+	s.listeners[l] = struct{}{}
+	s.listenersMutex.Unlock()
+}
+
+func (s *Sessions) Unsubscribe(l SessionListener) {
+	s.listenersMutex.Lock()
+	delete(s.listeners, l)
+	s.listenersMutex.Unlock()
+}
+
+func (s *Sessions) NotifyRevoked(sessionID string) error {
+	msg := &api.Msg{
+		Type:   api.TypeSessionRevoked,
+		SentAt: time.Now(),
+		Msg: &api.SessionRevoked{
+			SessionID: sessionID,
+		},
+	}
+	rawMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.revocations.Publish(sessionID, rawMsg)
+}
+
+func (s *Sessions) Receive(received *bus.Message) error {
+	revoked := &api.SessionRevoked{}
+	msg := &api.Msg{
+		Msg: revoked,
+	}
+	if err := json.Unmarshal(received.Data, msg); err != nil {
+		return err
+	}
+	if msg.Type != api.TypeSessionRevoked {
+		return nil
+	}
+
+	s.listenersMutex.Lock()
+	for l := range s.listeners {
+		l.ReceiveSessionRevoked(revoked)
+	}
+	s.listenersMutex.Unlock()
+	return nil
+}
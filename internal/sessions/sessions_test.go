@@ -0,0 +1,56 @@
+package sessions
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/bus"
+	"github.com/stretchr/testify/require"
+)
+
+type MockSessionListener struct {
+	Revoked []string
+	mutex   sync.Mutex
+}
+
+func (l *MockSessionListener) ReceiveSessionRevoked(msg *api.SessionRevoked) {
+	l.mutex.Lock()
+	l.Revoked = append(l.Revoked, msg.SessionID)
+	l.mutex.Unlock()
+}
+
+func (l *MockSessionListener) Get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.Revoked...)
+}
+
+func TestSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bus.NewMemory()
+	go events.Run(ctx)
+
+	// Two servers sharing the bus
+	s1 := NewSessions(events)
+	s1.Init()
+	defer s1.Close()
+	s2 := NewSessions(events)
+	s2.Init()
+	defer s2.Close()
+
+	var l1, l2 MockSessionListener
+	s1.Subscribe(&l1)
+	s2.Subscribe(&l2)
+
+	require.NoError(t, s1.NotifyRevoked("42"))
+
+	require.Eventually(t, func() bool {
+		return len(l1.Get()) == 1 && len(l2.Get()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"42"}, l2.Get())
+}
@@ -0,0 +1,38 @@
+package tickets
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ig0rmin/ich/internal/user"
+)
+
+type Handler struct {
+	*Tickets
+}
+
+func NewHandler(t *Tickets) *Handler {
+	return &Handler{t}
+}
+
+func (h *Handler) Route(root gin.IRouter) {
+	root.POST("/ws-ticket", h.CreateTicket)
+}
+
+// CreateTicket issues a ticket for the authenticated user
+func (h *Handler) CreateTicket(c *gin.Context) {
+	id, err := h.Tickets.Issue(c.Request.Context(), &Ticket{
+		UserName:  c.GetString(user.UserNameKey),
+		UserID:    c.GetString(user.UserIDKey),
+		SessionID: c.GetString(user.SessionIDKey),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":     id,
+		"expires_in": int(h.Tickets.ttl.Seconds()),
+	})
+}
@@ -0,0 +1,59 @@
+package tickets
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	ticket    *Ticket
+	expiresAt time.Time
+}
+
+// MemoryStore keeps the tickets in process, so a ticket can be used only
+// on the server instance that issued it
+type MemoryStore struct {
+	tickets map[string]entry
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tickets: make(map[string]entry),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryStore) Put(ctx context.Context, id string, ticket *Ticket, expiresAt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Forget the tickets that were never used
+	now := m.now()
+	for id, e := range m.tickets {
+		if now.After(e.expiresAt) {
+			delete(m.tickets, id)
+		}
+	}
+	m.tickets[id] = entry{ticket: ticket, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemoryStore) Take(ctx context.Context, id string) (*Ticket, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.tickets[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.tickets, id)
+	if m.now().After(e.expiresAt) {
+		return nil, nil
+	}
+	return e.ticket, nil
+}
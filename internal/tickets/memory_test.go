@@ -0,0 +1,47 @@
+package tickets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTickets(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	tickets := NewTickets(store, Config{TTL: 30 * time.Second})
+
+	id, err := tickets.Issue(ctx, &Ticket{UserName: "Patrick", SessionID: "1"})
+	require.NoError(t, err)
+	ticket, err := tickets.Redeem(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, "Patrick", ticket.UserName)
+	require.Equal(t, "1", ticket.SessionID)
+
+	// Tickets are single-use
+	_, err = tickets.Redeem(ctx, id)
+	require.ErrorIs(t, err, ErrInvalidTicket)
+
+	_, err = tickets.Redeem(ctx, "made-up")
+	require.ErrorIs(t, err, ErrInvalidTicket)
+
+	// And short-lived
+	id, err = tickets.Issue(ctx, &Ticket{UserName: "Patrick"})
+	require.NoError(t, err)
+	now = now.Add(31 * time.Second)
+	_, err = tickets.Redeem(ctx, id)
+	require.ErrorIs(t, err, ErrInvalidTicket)
+
+	// Expired tickets are forgotten
+	_, err = tickets.Issue(ctx, &Ticket{UserName: "Patrick"})
+	require.NoError(t, err)
+	now = now.Add(31 * time.Second)
+	_, err = tickets.Issue(ctx, &Ticket{UserName: "Patrick"})
+	require.NoError(t, err)
+	require.Len(t, store.tickets, 1)
+}
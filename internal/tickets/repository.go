@@ -0,0 +1,51 @@
+package tickets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Repository keeps the tickets in the database shared by all the server instances
+type Repository struct {
+	db *sql.DB
+}
+
+var _ Store = (*Repository)(nil)
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) Put(ctx context.Context, id string, ticket *Ticket, expiresAt time.Time) error {
+	query := `INSERT INTO ws_tickets(id, username, user_id, session_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.ExecContext(ctx, query, id, ticket.UserName, ticket.UserID, ticket.SessionID, expiresAt)
+	if err != nil {
+		return err
+	}
+	// Forget the tickets that were never used
+	_, err = r.db.ExecContext(ctx, "DELETE FROM ws_tickets WHERE expires_at < now()")
+	return err
+}
+
+func (r *Repository) Take(ctx context.Context, id string) (*Ticket, error) {
+	var ticket Ticket
+	var valid bool
+	query := `DELETE FROM ws_tickets WHERE id = $1
+		RETURNING username, user_id, session_id, expires_at > now()`
+	err := r.db.QueryRowContext(ctx, query, id).Scan(
+		&ticket.UserName,
+		&ticket.UserID,
+		&ticket.SessionID,
+		&valid,
+	)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !valid {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
@@ -0,0 +1,72 @@
+package tickets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+type Config struct {
+	// Tickets must be used to open the websocket within this time
+	TTL time.Duration `env:"ICH_WS_TICKET_TTL, default=30s"`
+}
+
+var ErrInvalidTicket = errors.New("invalid ticket")
+
+// Ticket lets the client open a websocket as the user who requested it,
+// without passing the access token in the URL
+type Ticket struct {
+	UserName string
+	UserID   string
+	// Session of the access token the ticket was requested with, it's checked for
+	// revocation when the ticket is used. Empty for the tokens of an external
+	// identity provider.
+	SessionID string
+}
+
+// Store keeps the tickets. Server instances share the tickets through the store,
+// so the ticket can be used on any instance.
+type Store interface {
+	Put(ctx context.Context, id string, ticket *Ticket, expiresAt time.Time) error
+	// Take returns the ticket and deletes it, so it can be used only once.
+	// It returns nil if the ticket is unknown or expired.
+	Take(ctx context.Context, id string) (*Ticket, error)
+}
+
+type Tickets struct {
+	store Store
+	ttl   time.Duration
+}
+
+func NewTickets(store Store, cfg Config) *Tickets {
+	return &Tickets{
+		store: store,
+		ttl:   cfg.TTL,
+	}
+}
+
+// Issue returns the ID of the new ticket
+func (t *Tickets) Issue(ctx context.Context, ticket *Ticket) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if err := t.store.Put(ctx, id, ticket, time.Now().Add(t.ttl)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (t *Tickets) Redeem(ctx context.Context, id string) (*Ticket, error) {
+	ticket, err := t.store.Take(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if ticket == nil {
+		return nil, ErrInvalidTicket
+	}
+	return ticket, nil
+}
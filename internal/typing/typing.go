@@ -0,0 +1,185 @@
+package typing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/bus"
+)
+
+type Config struct {
+	// A user stops typing if there is no typing notification from them for this long
+	TTL time.Duration `env:"ICH_TYPING_TTL, default=5s"`
+}
+
+type TypingListener interface {
+	ReceiveUserTyping(*api.UserTyping)
+	ReceiveUserStoppedTyping(*api.UserTyping)
+}
+
+type typist struct {
+	room     string
+	userName string
+}
+
+// Typing tracks users composing messages. Typing notifications are ephemeral,
+// so they go through their own bus and are not stored anywhere.
+type Typing struct {
+	events bus.Bus
+	ttl    time.Duration
+
+	// Expiration time of every user typing
+	typing      map[typist]time.Time
+	typingMutex sync.Mutex
+
+	// Listeners of every room
+	listeners      map[string]map[TypingListener]struct{}
+	listenersMutex sync.Mutex
+
+	wg *sync.WaitGroup
+}
+
+// Expiration is checked several times per TTL, shorter TTLs make no sense
+const minTTL = 100 * time.Millisecond
+
+func NewTyping(events bus.Bus, cfg Config) (*Typing, error) {
+	if cfg.TTL < minTTL {
+		return nil, fmt.Errorf("typing TTL must be at least %v", minTTL)
+	}
+	return &Typing{
+		events:    events,
+		ttl:       cfg.TTL,
+		typing:    make(map[typist]time.Time),
+		listeners: make(map[string]map[TypingListener]struct{}),
+		wg:        &sync.WaitGroup{},
+	}, nil
+}
+
+func (t *Typing) Init() {
+	t.events.Subscribe(t)
+}
+
+func (t *Typing) Close() {
+	t.events.Unsubscribe(t)
+}
+
+func (t *Typing) Subscribe(room string, l TypingListener) {
+	t.listenersMutex.Lock()
+	listeners, ok := t.listeners[room]
+	if !ok {
+		listeners = make(map[TypingListener]struct{})
+		t.listeners[room] = listeners
+	}
+	listeners[l] = struct{}{}
+	t.listenersMutex.Unlock()
+}
+
+func (t *Typing) Unsubscribe(room string, l TypingListener) {
+	t.listenersMutex.Lock()
+	delete(t.listeners[room], l)
+	if len(t.listeners[room]) == 0 {
+		delete(t.listeners, room)
+	}
+	t.listenersMutex.Unlock()
+}
+
+// NotifyTyping tells all the servers that the user is typing in the room.
+// Clients should repeat it while the user keeps typing.
+func (t *Typing) NotifyTyping(room, userName string) error {
+	msg := &api.Msg{
+		Type:   api.TypeUserTyping,
+		SentAt: time.Now(),
+		Msg: &api.UserTyping{
+			UserName: userName,
+			Room:     room,
+		},
+	}
+	rawMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.events.Publish(room, rawMsg)
+}
+
+func (t *Typing) Receive(received *bus.Message) error {
+	user := &api.UserTyping{}
+	msg := &api.Msg{
+		Msg: user,
+	}
+	if err := json.Unmarshal(received.Data, msg); err != nil {
+		return err
+	}
+	// The events bus carries other events too
+	if msg.Type != api.TypeUserTyping {
+		return nil
+	}
+
+	key := typist{room: user.Room, userName: user.UserName}
+	t.typingMutex.Lock()
+	_, refresh := t.typing[key]
+	t.typing[key] = time.Now().Add(t.ttl)
+	t.typingMutex.Unlock()
+
+	// Listeners are notified only when the user starts typing
+	if !refresh {
+		t.notifyListeners(user.Room, func(l TypingListener) {
+			l.ReceiveUserTyping(user)
+		})
+	}
+	return nil
+}
+
+// Run expires users who stopped typing
+func (t *Typing) Run(ctx context.Context) {
+	t.wg.Add(1)
+	ticker := time.NewTicker(t.ttl / 5)
+	defer ticker.Stop()
+Loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			t.expire(now)
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	t.wg.Done()
+}
+
+func (t *Typing) Wait() {
+	t.wg.Wait()
+}
+
+func (t *Typing) expire(now time.Time) {
+	var expired []typist
+	t.typingMutex.Lock()
+	for key, expiresAt := range t.typing {
+		if now.After(expiresAt) {
+			expired = append(expired, key)
+			delete(t.typing, key)
+		}
+	}
+	t.typingMutex.Unlock()
+
+	for _, key := range expired {
+		user := &api.UserTyping{
+			UserName: key.userName,
+			Room:     key.room,
+		}
+		t.notifyListeners(user.Room, func(l TypingListener) {
+			l.ReceiveUserStoppedTyping(user)
+		})
+	}
+}
+
+func (t *Typing) notifyListeners(room string, notify func(TypingListener)) {
+	t.listenersMutex.Lock()
+	for l := range t.listeners[room] {
+		notify(l)
+	}
+	t.listenersMutex.Unlock()
+}
@@ -0,0 +1,83 @@
+package typing
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/bus"
+	"github.com/stretchr/testify/require"
+)
+
+type MockTypingListener struct {
+	Typing  []string
+	Stopped []string
+	mutex   sync.Mutex
+}
+
+func (l *MockTypingListener) ReceiveUserTyping(user *api.UserTyping) {
+	l.mutex.Lock()
+	l.Typing = append(l.Typing, user.UserName)
+	l.mutex.Unlock()
+}
+
+func (l *MockTypingListener) ReceiveUserStoppedTyping(user *api.UserTyping) {
+	l.mutex.Lock()
+	l.Stopped = append(l.Stopped, user.UserName)
+	l.mutex.Unlock()
+}
+
+func (l *MockTypingListener) Len() (typing int, stopped int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.Typing), len(l.Stopped)
+}
+
+func TestTyping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bus.NewMemory()
+	go events.Run(ctx)
+
+	typing, err := NewTyping(events, Config{TTL: 200 * time.Millisecond})
+	require.NoError(t, err)
+	typing.Init()
+	defer typing.Close()
+	go typing.Run(ctx)
+
+	var listener, otherRoomListener MockTypingListener
+	typing.Subscribe("lobby", &listener)
+	typing.Subscribe("other", &otherRoomListener)
+
+	// Repeated notifications don't produce new events
+	typing.NotifyTyping("lobby", "Patrick")
+	typing.NotifyTyping("lobby", "Patrick")
+
+	require.Eventually(t, func() bool {
+		started, _ := listener.Len()
+		return started == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Typing expires without notifications
+	require.Eventually(t, func() bool {
+		_, stopped := listener.Len()
+		return stopped == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, []string{"Patrick"}, listener.Typing)
+	require.Equal(t, []string{"Patrick"}, listener.Stopped)
+
+	started, stopped := otherRoomListener.Len()
+	require.Equal(t, 0, started)
+	require.Equal(t, 0, stopped)
+}
+
+func TestTypingConfig(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Nanosecond, -time.Second} {
+		_, err := NewTyping(bus.NewMemory(), Config{TTL: ttl})
+		require.Error(t, err, ttl)
+	}
+}
@@ -1,5 +1,7 @@
 package user
 
+import "time"
+
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
@@ -7,6 +9,13 @@ type User struct {
 	Password string `json:"password"`
 }
 
+type Session struct {
+	ID               string
+	UserID           int
+	RefreshTokenHash string
+	ExpiresAt        time.Time
+}
+
 type CreateUserReq struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required"`
@@ -28,4 +37,10 @@ type LoginUserRes struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// Exchanged for a new access token when it expires
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
@@ -1,22 +1,31 @@
 package user
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ig0rmin/ich/internal/ratelimit"
 )
 
 type Handler struct {
 	*Service
+	loginLimiter *ratelimit.Limiter
 }
 
-func NewHandler(s *Service) *Handler {
-	return &Handler{s}
+func NewHandler(s *Service, loginLimiter *ratelimit.Limiter) *Handler {
+	return &Handler{s, loginLimiter}
 }
 
 func (h *Handler) Route(root gin.IRouter) {
 	root.POST("/createUser", h.CreateUser)
-	root.POST("/login", h.Login)
+	root.POST("/login", ratelimit.ByIP(h.loginLimiter), h.Login)
+	root.POST("/refresh", h.Refresh)
+}
+
+// RouteAuthenticated sets up the routes requiring the access token
+func (h *Handler) RouteAuthenticated(root gin.IRouter) {
+	root.POST("/logout", h.Logout)
 }
 
 func (h *Handler) CreateUser(c *gin.Context) {
@@ -50,3 +59,33 @@ func (h *Handler) Login(c *gin.Context) {
 
 	c.JSON(http.StatusOK, resp)
 }
+
+func (h *Handler) Refresh(c *gin.Context) {
+	var req RefreshReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.Service.Refresh(c.Request.Context(), &req)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) Logout(c *gin.Context) {
+	err := h.Service.Logout(c.Request.Context(), c.GetString(SessionIDKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -3,6 +3,7 @@ package user
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
 type Repository struct {
@@ -38,3 +39,48 @@ func (r *Repository) GetUserByEmail(ctx context.Context, email string) (*User, e
 	}
 	return &user, nil
 }
+
+func (r *Repository) CreateSession(ctx context.Context, s *Session) error {
+	query := "INSERT INTO sessions(id, user_id, refresh_token_hash, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := r.db.ExecContext(ctx, query, s.ID, s.UserID, s.RefreshTokenHash, s.ExpiresAt)
+	return err
+}
+
+// RotateRefreshToken replaces the refresh token of the session and prolongs it.
+// It returns sql.ErrNoRows if the token is unknown, expired or revoked.
+func (r *Repository) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (string, *User, error) {
+	var sessionID string
+	var user User
+	query := `UPDATE sessions SET refresh_token_hash = $2, expires_at = $3
+		FROM users
+		WHERE sessions.refresh_token_hash = $1 AND sessions.revoked_at IS NULL
+			AND sessions.expires_at > now() AND users.id = sessions.user_id
+		RETURNING sessions.id, users.id, users.email, users.username`
+	err := r.db.QueryRowContext(ctx, query, oldHash, newHash, expiresAt).Scan(
+		&sessionID,
+		&user.ID,
+		&user.Email,
+		&user.Username,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	return sessionID, &user, nil
+}
+
+// RevokeSession makes the refresh token and all the access tokens of the session invalid
+func (r *Repository) RevokeSession(ctx context.Context, sessionID string) error {
+	query := "UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, sessionID)
+	return err
+}
+
+// IsSessionRevoked returns true if the session is revoked or unknown
+func (r *Repository) IsSessionRevoked(ctx context.Context, sessionID string) (bool, error) {
+	var valid bool
+	query := "SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND revoked_at IS NULL)"
+	if err := r.db.QueryRowContext(ctx, query, sessionID).Scan(&valid); err != nil {
+		return false, err
+	}
+	return !valid, nil
+}
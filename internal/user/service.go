@@ -2,27 +2,46 @@ package user
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/ig0rmin/ich/internal/auth"
+	"github.com/ig0rmin/ich/internal/sessions"
 	"golang.org/x/crypto/bcrypt"
 )
 
+type Config struct {
+	// Access tokens are short-lived, clients get new ones with the refresh token
+	AccessTokenTTL  time.Duration `env:"ICH_ACCESS_TOKEN_TTL, default=15m"`
+	RefreshTokenTTL time.Duration `env:"ICH_REFRESH_TOKEN_TTL, default=720h"`
+}
+
+// Keys of the token claims in the request context
 const (
-	UserNameKey = "username"
-	UserIDKey   = "id"
+	UserNameKey  = "username"
+	UserIDKey    = "id"
+	SessionIDKey = "sid"
 )
 
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
 type Service struct {
 	*Repository
-	serverSecret string
+	keys     *auth.Keys
+	cfg      Config
+	sessions *sessions.Sessions
 }
 
-func NewService(r *Repository, serverSecret string) *Service {
-	return &Service{r, serverSecret}
+func NewService(r *Repository, keys *auth.Keys, cfg Config, sessions *sessions.Sessions) *Service {
+	return &Service{r, keys, cfg, sessions}
 }
 
 func hashPassword(password string) (string, error) {
@@ -65,11 +84,27 @@ func (s *Service) CreateUser(ctx context.Context, req *CreateUserReq) (*CreateUs
 }
 
 type JWTClaims struct {
-	ID       string `json:"id"`
-	UserName string `json:"username"`
+	ID        string `json:"id"`
+	UserName  string `json:"username"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Only hashes of the refresh tokens are stored, so the tokens
+// can't be stolen from the database
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func (s *Service) Login(ctx context.Context, req *LoginUserReq) (*LoginUserRes, error) {
 	user, err := s.Repository.GetUserByEmail(ctx, req.Email)
 	if err != nil {
@@ -80,19 +115,78 @@ func (s *Service) Login(ctx context.Context, req *LoginUserReq) (*LoginUserRes,
 		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
-		ID:       strconv.Itoa(user.ID),
-		UserName: user.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    strconv.Itoa(user.ID),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
+	sessionID, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Repository.CreateSession(ctx, &Session{
+		ID:               sessionID,
+		UserID:           user.ID,
+		RefreshTokenHash: hashRefreshToken(refreshToken),
+		ExpiresAt:        time.Now().Add(s.cfg.RefreshTokenTTL),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(user, sessionID, refreshToken)
+}
 
-	ss, err := token.SignedString([]byte(s.serverSecret))
+// Refresh replaces the refresh token with a new one and issues a new access token
+func (s *Service) Refresh(ctx context.Context, req *RefreshReq) (*LoginUserRes, error) {
+	refreshToken, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, user, err := s.Repository.RotateRefreshToken(ctx,
+		hashRefreshToken(req.RefreshToken),
+		hashRefreshToken(refreshToken),
+		time.Now().Add(s.cfg.RefreshTokenTTL))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(user, sessionID, refreshToken)
+}
+
+// Logout revokes the session with all its tokens, and disconnects
+// the websockets of the session on all the servers
+func (s *Service) Logout(ctx context.Context, sessionID string) error {
+	if err := s.Repository.RevokeSession(ctx, sessionID); err != nil {
+		return err
+	}
+	return s.sessions.NotifyRevoked(sessionID)
+}
+
+func (s *Service) issueTokens(user *User, sessionID, refreshToken string) (*LoginUserRes, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := JWTClaims{
+		ID:               strconv.Itoa(user.ID),
+		UserName:         user.Username,
+		SessionID:        sessionID,
+		RegisteredClaims: s.keys.RegisteredClaims(strconv.Itoa(user.ID), time.Now().Add(s.cfg.AccessTokenTTL)),
+	}
+	claims.RegisteredClaims.ID = jti
+	ss, err := s.keys.Sign(claims)
 	if err != nil {
 		return nil, err
 	}
 
-	return &LoginUserRes{Token: ss, Username: user.Username, ID: strconv.Itoa(user.ID)}, nil
+	return &LoginUserRes{
+		Token:        ss,
+		RefreshToken: refreshToken,
+		Username:     user.Username,
+		ID:           strconv.Itoa(user.ID),
+	}, nil
 }
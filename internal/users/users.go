@@ -1,219 +1,947 @@
 package users
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/ig0rmin/ich/internal/api"
-	"github.com/ig0rmin/ich/internal/kafka"
+	"github.com/ig0rmin/ich/internal/bus"
 )
 
+type Config struct {
+	// How often the server advertises its users to other servers
+	HeartbeatInterval time.Duration `env:"ICH_PRESENCE_HEARTBEAT_INTERVAL, default=5s"`
+	// Users of a server that hasn't advertised them for this long are considered gone,
+	// must be greater than HeartbeatInterval
+	TTL time.Duration `env:"ICH_PRESENCE_TTL, default=15s"`
+	// Online users who don't send anything from any of their connections
+	// for this long become away, 0 disables it
+	AwayTimeout time.Duration `env:"ICH_PRESENCE_AWAY_TIMEOUT, default=5m"`
+}
+
+const maxStatusTextLength = 128
+
+var ErrInvalidStatus = errors.New("invalid status")
+
 type UserEventsListener interface {
 	ReceiveUserJoined(msg *api.UserJoinedMsg)
 	ReceiveUserLeft(msg *api.UserLeftMsg)
+	ReceiveUserStatusChanged(msg *api.UserStatusChanged)
+}
+
+// Set of user names in every room
+type roomUsers map[string]map[string]struct{}
+
+func (r roomUsers) add(room, userName string) {
+	users, ok := r[room]
+	if !ok {
+		users = make(map[string]struct{})
+		r[room] = users
+	}
+	users[userName] = struct{}{}
+}
+
+func (r roomUsers) remove(room, userName string) {
+	delete(r[room], userName)
+	if len(r[room]) == 0 {
+		delete(r, room)
+	}
+}
+
+func (r roomUsers) contains(room, userName string) bool {
+	_, ok := r[room][userName]
+	return ok
+}
+
+func (r roomUsers) clone() roomUsers {
+	res := make(roomUsers, len(r))
+	for room, users := range r {
+		for name := range users {
+			res.add(room, name)
+		}
+	}
+	return res
+}
+
+// Number of sessions of every user in every room
+type roomSessions map[string]map[string]int
+
+// add returns true if it's the first session of the user in the room
+func (r roomSessions) add(room, userName string) bool {
+	sessions, ok := r[room]
+	if !ok {
+		sessions = make(map[string]int)
+		r[room] = sessions
+	}
+	sessions[userName]++
+	return sessions[userName] == 1
+}
+
+// remove returns true if it was the last session of the user in the room
+func (r roomSessions) remove(room, userName string) bool {
+	sessions := r[room]
+	if sessions[userName] == 0 {
+		return false
+	}
+	sessions[userName]--
+	if sessions[userName] > 0 {
+		return false
+	}
+	delete(sessions, userName)
+	if len(sessions) == 0 {
+		delete(r, room)
+	}
+	return true
 }
 
+func (r roomSessions) hasUser(userName string) bool {
+	for _, sessions := range r {
+		if sessions[userName] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type member struct {
+	room     string
+	userName string
+}
+
+type serverState struct {
+	users roomUsers
+	// Last activity of the users, as advertised by the server
+	activeAt map[string]time.Time
+	// When we last heard from the server
+	lastSeen time.Time
+	// Sequence number of the last message from the server
+	seq int64
+	// Version of the last message from the server
+	version int64
+}
+
+// UserManager tracks users online on all the servers. Every server publishes
+// the snapshot of its users (a heartbeat) to a compacted bus keyed by the server ID
+// whenever they change and periodically, so a new server reads the snapshots of
+// all the servers online on start.
+//
+// The messages are built under localUsersMutex and published after it's released,
+// so users joining and leaving don't wait for the bus to acknowledge each other's
+// messages. Concurrent publishes may reach the bus out of order, so the messages
+// carry the version they were built with and the servers drop the stale ones.
+// A stale heartbeat left last in the snapshot is fixed by the next one.
 type UserManager struct {
-	users *kafka.Kafka
+	users    bus.Compacted
+	cfg      Config
+	serverID string
 
-	// Users on this server
-	localUsers      map[string]struct{}
+	// Sessions and statuses of the users on this server
+	localUsers    roomSessions
+	localStatuses map[string]api.UserPresence
+	// Set when the server is shutting down
+	left bool
+	// Version of the last message built
+	version         int64
 	localUsersMutex sync.Mutex
+	// Messages built but not published yet
+	publishing sync.WaitGroup
 
-	// All users (from all servers)
-	usersOnline      map[string]struct{}
-	usersOnlineMutex sync.Mutex
+	// Every message from a client marks the user active, so the activity has its
+	// own lock. It's taken after localUsersMutex when both are needed, and never
+	// held while building the messages.
+	// Last activity of the users on this server
+	localActiveAt map[string]time.Time
+	// Users this server made away due to inactivity
+	autoAway map[string]struct{}
+	// Users made away who were active since then, they are coming back online
+	comingBack    map[string]struct{}
+	activityMutex sync.Mutex
 
-	listeners      map[UserEventsListener]struct{}
+	// Users of every server (including this one), as advertised by the servers
+	servers map[string]*serverState
+	// Statuses of the users online, a user has the same status in every room
+	statuses     map[string]api.UserPresence
+	serversMutex sync.Mutex
+
+	// Listeners of every room
+	listeners      map[string]map[UserEventsListener]struct{}
 	listenersMutex sync.Mutex
+
+	now func() time.Time
+	wg  *sync.WaitGroup
 }
 
-func NewUserManager(users *kafka.Kafka) (*UserManager, error) {
+func NewUserManager(users bus.Compacted, cfg Config) (*UserManager, error) {
+	if cfg.HeartbeatInterval <= 0 {
+		return nil, errors.New("presence heartbeat interval must be positive")
+	}
+	// Otherwise servers evict each other between the heartbeats
+	if cfg.TTL <= cfg.HeartbeatInterval {
+		return nil, errors.New("presence TTL must be greater than the heartbeat interval")
+	}
 	u := &UserManager{
-		users:       users,
-		usersOnline: make(map[string]struct{}),
-		localUsers:  make(map[string]struct{}),
-		listeners:   make(map[UserEventsListener]struct{}),
+		users:         users,
+		cfg:           cfg,
+		serverID:      newServerID(),
+		servers:       make(map[string]*serverState),
+		statuses:      make(map[string]api.UserPresence),
+		localUsers:    make(roomSessions),
+		localStatuses: make(map[string]api.UserPresence),
+		localActiveAt: make(map[string]time.Time),
+		autoAway:      make(map[string]struct{}),
+		comingBack:    make(map[string]struct{}),
+		listeners:     make(map[string]map[UserEventsListener]struct{}),
+		now:           time.Now,
+		wg:            &sync.WaitGroup{},
 	}
 	return u, nil
 }
 
-func (u *UserManager) Init() {
+func newServerID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Init reads the users online from the snapshot. The server shouldn't accept
+// users until it's done.
+func (u *UserManager) Init(ctx context.Context) error {
+	// Subscribe first not to miss the messages published while reading the snapshot,
+	// sequence numbers tell which of them are newer than the snapshot.
 	u.users.Subscribe(u)
-	// Make all servers advertise their users to build the list of users online
-	u.notifyServerJoined()
+
+	snapshot, err := u.users.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	for _, received := range snapshot {
+		var msg api.Msg
+		if err := json.Unmarshal(received.Data, &msg); err != nil {
+			return err
+		}
+		// The server crashed before publishing the heartbeat after the last change.
+		// It will be evicted or fixed by the next heartbeat.
+		if msg.Type != api.TypeServerHeartbeat {
+			continue
+		}
+		// The server is gone for long, but nobody evicted it. Its users are ignored,
+		// and the server is evicted as usual unless it sends a heartbeat.
+		if time.Since(msg.SentAt) > u.cfg.TTL {
+			u.updateServer(received.Key, received.Seq, 0, msg.SentAt, func(users roomUsers) roomUsers {
+				return users
+			})
+			continue
+		}
+		u.onServerHeartbeat(received.Seq, msg.SentAt, msg.Msg)
+	}
+	log.Infof("Loaded users of %v servers", len(snapshot))
+	return nil
+}
+
+// Leave removes the server from the snapshot, so its users are gone everywhere.
+// The server doesn't send heartbeats after that.
+func (u *UserManager) Leave() {
+	u.localUsersMutex.Lock()
+	u.left = true
+	u.localUsersMutex.Unlock()
+	// Nothing may follow the removal
+	u.publishing.Wait()
+	if err := u.users.Publish(u.serverID, nil); err != nil {
+		log.Errorf("Can't remove the server from the snapshot: %v", err)
+	}
 }
 
 func (u *UserManager) Close() {
 	u.users.Unsubscribe(u)
 }
 
-func (u *UserManager) Subscribe(l UserEventsListener) {
+// Run advertises users of this server, evicts users of the servers that went silent
+// and makes inactive users away
+func (u *UserManager) Run(ctx context.Context) {
+	u.wg.Add(1)
+	ticker := time.NewTicker(u.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+Loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			u.publishHeartbeat()
+			u.evictServers(now)
+			u.checkAway(now)
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	u.wg.Done()
+}
+
+func (u *UserManager) Wait() {
+	u.wg.Wait()
+}
+
+func (u *UserManager) Subscribe(room string, l UserEventsListener) {
 	u.listenersMutex.Lock()
-	u.listeners[l] = struct{}{}
+	listeners, ok := u.listeners[room]
+	if !ok {
+		listeners = make(map[UserEventsListener]struct{})
+		u.listeners[room] = listeners
+	}
+	listeners[l] = struct{}{}
 	u.listenersMutex.Unlock()
 }
 
-func (u *UserManager) Unsubscribe(l UserEventsListener) {
+func (u *UserManager) Unsubscribe(room string, l UserEventsListener) {
 	u.listenersMutex.Lock()
-	delete(u.listeners, l)
+	delete(u.listeners[room], l)
+	if len(u.listeners[room]) == 0 {
+		delete(u.listeners, room)
+	}
 	u.listenersMutex.Unlock()
 }
 
-func (u *UserManager) Receive(data []byte) error {
+func (u *UserManager) Receive(received *bus.Message) error {
+	// All the messages are keyed by the server ID, no data means the server is gone
+	if received.Data == nil {
+		u.onServerGone(received.Seq, received.Key)
+		return nil
+	}
 	var msg api.Msg
-	if err := json.Unmarshal(data, &msg); err != nil {
+	if err := json.Unmarshal(received.Data, &msg); err != nil {
 		return err
 	}
 	switch msg.Type {
-	case api.TypeServerJoined:
-		u.onServerJoined()
+	case api.TypeServerHeartbeat:
+		u.onServerHeartbeat(received.Seq, time.Now(), msg.Msg)
 	case api.TypeUserJoined:
-		u.onUserJoined(msg.Msg)
+		u.onUserJoined(received.Seq, msg.Msg)
 	case api.TypeUserLeft:
-		u.onUserLeft(msg.Msg)
-	case api.TypeUsersOnline:
-		u.onUsersOnline(msg.Msg)
+		u.onUserLeft(received.Seq, msg.Msg)
+	case api.TypeUserStatusChanged:
+		u.onUserStatusChanged(received.Seq, msg.Msg)
 	default:
 		log.Error("Unsupported message type")
 	}
 	return nil
 }
 
-// When a new server joins, each server online advertises its users
-// so the newcomer can build the list of users online
-func (u *UserManager) onServerJoined() error {
-	users := &api.UsersOnline{
-		List: make([]string, 0, len(u.localUsers)),
+func (u *UserManager) onServerGone(seq int64, serverID string) {
+	if serverID == u.serverID {
+		return
 	}
-	u.localUsersMutex.Lock()
-	for name := range u.localUsers {
-		users.List = append(users.List, name)
+	u.serversMutex.Lock()
+	server, ok := u.servers[serverID]
+	if !ok || seq <= server.seq {
+		u.serversMutex.Unlock()
+		return
 	}
-	u.localUsersMutex.Unlock()
+	delete(u.servers, serverID)
+	joined, left := u.diffLocked(serverID, server.users, nil)
+	u.forgetStatusesLocked(left)
+	u.serversMutex.Unlock()
 
-	msg := &api.Msg{
-		Type:   api.TypeUsersOnline,
-		SentAt: time.Now(),
-		Msg:    &users,
-	}
-	return u.pulbishMsg(msg)
+	u.notifyListeners(joined, left)
 }
 
-func (u *UserManager) onUserJoined(msg any) error {
-	rawMsg, err := json.Marshal(msg)
-	if err != nil {
+func (u *UserManager) onServerHeartbeat(seq int64, seenAt time.Time, msg any) error {
+	var heartbeat api.ServerHeartbeat
+	if err := decodeMsg(msg, &heartbeat); err != nil {
 		return err
 	}
-	var user api.UserJoinedMsg
-	if err := json.Unmarshal(rawMsg, &user); err != nil {
-		return err
+	users := make(roomUsers)
+	for _, room := range heartbeat.Rooms {
+		for _, user := range room.List {
+			users.add(room.Room, user.UserName)
+		}
+	}
+	if !u.updateServer(heartbeat.ServerID, seq, heartbeat.Version, seenAt, func(roomUsers) roomUsers {
+		return users
+	}) {
+		return nil
 	}
-	u.usersOnlineMutex.Lock()
-	u.usersOnline[user.UserName] = struct{}{}
-	u.usersOnlineMutex.Unlock()
 
-	u.listenersMutex.Lock()
-	for l := range u.listeners {
-		l.ReceiveUserJoined(&user)
+	// Heartbeats fix the statuses, but don't produce events
+	u.serversMutex.Lock()
+	if server, ok := u.servers[heartbeat.ServerID]; ok {
+		server.activeAt = heartbeat.ActiveAt
 	}
-	u.listenersMutex.Unlock()
+	for _, room := range heartbeat.Rooms {
+		for _, user := range room.List {
+			u.statuses[user.UserName] = user
+		}
+	}
+	u.serversMutex.Unlock()
 	return nil
 }
 
-func (u *UserManager) onUserLeft(msg any) error {
-	rawMsg, err := json.Marshal(msg)
-	if err != nil {
+func (u *UserManager) onUserJoined(seq int64, msg any) error {
+	var user api.UserJoinedMsg
+	if err := decodeMsg(msg, &user); err != nil {
 		return err
 	}
+	u.updateServer(user.ServerID, seq, user.Version, time.Now(), func(users roomUsers) roomUsers {
+		users = users.clone()
+		users.add(user.Room, user.UserName)
+		return users
+	})
+	return nil
+}
+
+func (u *UserManager) onUserLeft(seq int64, msg any) error {
 	var user api.UserLeftMsg
-	if err := json.Unmarshal(rawMsg, &user); err != nil {
+	if err := decodeMsg(msg, &user); err != nil {
 		return err
 	}
-	u.usersOnlineMutex.Lock()
-	delete(u.usersOnline, user.UserName)
-	u.usersOnlineMutex.Unlock()
+	u.updateServer(user.ServerID, seq, user.Version, time.Now(), func(users roomUsers) roomUsers {
+		users = users.clone()
+		users.remove(user.Room, user.UserName)
+		return users
+	})
+	return nil
+}
+
+func (u *UserManager) onUserStatusChanged(seq int64, msg any) error {
+	var changed api.UserStatusChanged
+	if err := decodeMsg(msg, &changed); err != nil {
+		return err
+	}
+	if !u.updateServer(changed.ServerID, seq, changed.Version, time.Now(), func(users roomUsers) roomUsers {
+		return users
+	}) {
+		return nil
+	}
+	presence := api.UserPresence{
+		UserName:   changed.UserName,
+		Status:     changed.Status,
+		StatusText: changed.StatusText,
+	}
+
+	// Other sessions of the user on this server get the same status
+	u.localUsersMutex.Lock()
+	_, local := u.localStatuses[changed.UserName]
+	if local {
+		u.localStatuses[changed.UserName] = presence
+	}
+	if local && changed.ServerID != u.serverID {
+		u.activityMutex.Lock()
+		// The status isn't the one this server set due to inactivity anymore
+		delete(u.autoAway, changed.UserName)
+		// The user was active elsewhere, so this server doesn't make them away
+		// before it hears about the activity
+		if changed.Status == api.StatusOnline {
+			u.localActiveAt[changed.UserName] = u.now()
+		}
+		u.activityMutex.Unlock()
+	}
+	u.localUsersMutex.Unlock()
+	if local && changed.ServerID != u.serverID {
+		u.publishHeartbeat()
+	}
+
+	u.serversMutex.Lock()
+	u.statuses[changed.UserName] = presence
+	rooms := make(map[string]struct{})
+	for _, server := range u.servers {
+		for room, names := range server.users {
+			if _, ok := names[changed.UserName]; ok {
+				rooms[room] = struct{}{}
+			}
+		}
+	}
+	u.serversMutex.Unlock()
 
 	u.listenersMutex.Lock()
-	for l := range u.listeners {
-		l.ReceiveUserLeft(&user)
+	for room := range rooms {
+		user := &api.UserStatusChanged{
+			UserName:   changed.UserName,
+			Room:       room,
+			Status:     changed.Status,
+			StatusText: changed.StatusText,
+		}
+		for l := range u.listeners[room] {
+			l.ReceiveUserStatusChanged(user)
+		}
 	}
 	u.listenersMutex.Unlock()
 	return nil
 }
 
-func (u *UserManager) onUsersOnline(msg any) error {
+func decodeMsg(msg any, v any) error {
 	rawMsg, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	var users api.UsersOnline
-	if err := json.Unmarshal(rawMsg, &users); err != nil {
-		return err
+	return json.Unmarshal(rawMsg, v)
+}
+
+// updateServer changes the users of the server and notifies listeners about
+// users who joined or left the cluster as a result. It returns false if the
+// message from the server was already applied, or a newer one was. Messages
+// without a version aren't checked for that.
+func (u *UserManager) updateServer(serverID string, seq, version int64, seenAt time.Time, update func(roomUsers) roomUsers) bool {
+	u.serversMutex.Lock()
+	server, ok := u.servers[serverID]
+	if !ok {
+		server = &serverState{users: make(roomUsers)}
+		u.servers[serverID] = server
 	}
-	u.usersOnlineMutex.Lock()
-	for _, name := range users.List {
-		u.usersOnline[name] = struct{}{}
+	if seq <= server.seq || version > 0 && version <= server.version {
+		u.serversMutex.Unlock()
+		return false
 	}
-	u.usersOnlineMutex.Unlock()
-	return nil
+	server.seq = seq
+	if version > 0 {
+		server.version = version
+	}
+	server.lastSeen = seenAt
+	before := server.users
+	server.users = update(before)
+	joined, left := u.diffLocked(serverID, before, server.users)
+	u.forgetStatusesLocked(left)
+	u.serversMutex.Unlock()
+
+	u.notifyListeners(joined, left)
+	return true
 }
 
-func (u *UserManager) GetUsersOnline() []string {
-	res := make([]string, 0, len(u.usersOnline))
-	u.usersOnlineMutex.Lock()
-	for name := range u.usersOnline {
-		res = append(res, name)
+// evictServers forgets users of the servers we haven't heard from for too long,
+// e.g. because they crashed
+func (u *UserManager) evictServers(now time.Time) {
+	var evicted []string
+	var joined, left []member
+	u.serversMutex.Lock()
+	for serverID, server := range u.servers {
+		if serverID == u.serverID || now.Sub(server.lastSeen) <= u.cfg.TTL {
+			continue
+		}
+		log.Infof("Server %v went silent, evicting its users", serverID)
+		delete(u.servers, serverID)
+		evicted = append(evicted, serverID)
+		j, l := u.diffLocked(serverID, server.users, nil)
+		joined = append(joined, j...)
+		left = append(left, l...)
+	}
+	u.forgetStatusesLocked(left)
+	u.serversMutex.Unlock()
+
+	// Remove the servers from the snapshot
+	for _, serverID := range evicted {
+		if err := u.users.Publish(serverID, nil); err != nil {
+			log.Errorf("Can't remove server %v from the snapshot: %v", serverID, err)
+		}
+	}
+
+	u.notifyListeners(joined, left)
+}
+
+// diffLocked returns users who became online or offline on all the servers when
+// the users of the server changed from before to after
+func (u *UserManager) diffLocked(serverID string, before, after roomUsers) (joined, left []member) {
+	for room, names := range after {
+		for name := range names {
+			if !before.contains(room, name) && !u.onlineElsewhereLocked(serverID, room, name) {
+				joined = append(joined, member{room: room, userName: name})
+			}
+		}
+	}
+	for room, names := range before {
+		for name := range names {
+			if !after.contains(room, name) && !u.onlineElsewhereLocked(serverID, room, name) {
+				left = append(left, member{room: room, userName: name})
+			}
+		}
+	}
+	return joined, left
+}
+
+// forgetStatusesLocked forgets the statuses of the users who left all the rooms
+func (u *UserManager) forgetStatusesLocked(left []member) {
+	for _, m := range left {
+		online := false
+		for _, server := range u.servers {
+			for _, names := range server.users {
+				if _, ok := names[m.userName]; ok {
+					online = true
+				}
+			}
+		}
+		if !online {
+			delete(u.statuses, m.userName)
+		}
+	}
+}
+
+func (u *UserManager) onlineElsewhereLocked(serverID, room, userName string) bool {
+	for id, server := range u.servers {
+		if id != serverID && server.users.contains(room, userName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UserManager) notifyListeners(joined, left []member) {
+	if len(joined) == 0 && len(left) == 0 {
+		return
+	}
+	u.listenersMutex.Lock()
+	for _, m := range joined {
+		user := &api.UserJoinedMsg{UserName: m.userName, Room: m.room}
+		for l := range u.listeners[m.room] {
+			l.ReceiveUserJoined(user)
+		}
+	}
+	for _, m := range left {
+		user := &api.UserLeftMsg{UserName: m.userName, Room: m.room}
+		for l := range u.listeners[m.room] {
+			l.ReceiveUserLeft(user)
+		}
+	}
+	u.listenersMutex.Unlock()
+}
+
+func (u *UserManager) GetUsersOnline(room string) []api.UserPresence {
+	u.serversMutex.Lock()
+	defer u.serversMutex.Unlock()
+
+	online := make(map[string]struct{})
+	for _, server := range u.servers {
+		for name := range server.users[room] {
+			online[name] = struct{}{}
+		}
+	}
+	res := make([]api.UserPresence, 0, len(online))
+	for name := range online {
+		res = append(res, u.statusLocked(name))
 	}
-	u.usersOnlineMutex.Unlock()
 	return res
 }
 
-func (u *UserManager) notifyServerJoined() error {
+// GetStatus returns the presence status of the user
+func (u *UserManager) GetStatus(userName string) api.UserPresence {
+	u.serversMutex.Lock()
+	defer u.serversMutex.Unlock()
+	return u.statusLocked(userName)
+}
+
+func (u *UserManager) statusLocked(userName string) api.UserPresence {
+	if presence, ok := u.statuses[userName]; ok {
+		return presence
+	}
+	// Users who haven't set a status yet are online
+	return api.UserPresence{
+		UserName: userName,
+		Status:   api.StatusOnline,
+	}
+}
+
+// SetStatus changes the status of the user connected to this server in all the rooms.
+// The status chosen by the user overrides the automatic one.
+func (u *UserManager) SetStatus(userName, status, statusText string) error {
+	switch status {
+	case api.StatusOnline, api.StatusAway, api.StatusBusy:
+	default:
+		return ErrInvalidStatus
+	}
+	if len(statusText) > maxStatusTextLength {
+		return ErrInvalidStatus
+	}
+
+	u.localUsersMutex.Lock()
+	u.activityMutex.Lock()
+	delete(u.autoAway, userName)
+	u.activityMutex.Unlock()
+	msgs := u.setStatusLocked(userName, status, statusText)
+	u.localUsersMutex.Unlock()
+	return u.publish(msgs)
+}
+
+func (u *UserManager) setStatusLocked(userName, status, statusText string) []*api.Msg {
+	u.localStatuses[userName] = api.UserPresence{
+		UserName:   userName,
+		Status:     status,
+		StatusText: statusText,
+	}
+
 	msg := &api.Msg{
-		Type:   "server_joined",
+		Type:   api.TypeUserStatusChanged,
 		SentAt: time.Now(),
+		Msg: &api.UserStatusChanged{
+			UserName:   userName,
+			Status:     status,
+			StatusText: statusText,
+			ServerID:   u.serverID,
+			Version:    u.nextVersionLocked(),
+		},
 	}
-	return u.pulbishMsg(msg)
+	return u.changeLocked(msg)
 }
 
-func (u *UserManager) NotifyUserJoined(userName string) error {
+func (u *UserManager) publishHeartbeat() error {
 	u.localUsersMutex.Lock()
-	u.localUsers[userName] = struct{}{}
+	msgs := u.batchLocked(u.heartbeatLocked())
 	u.localUsersMutex.Unlock()
+	return u.publish(msgs)
+}
+
+// MarkActive tells that the user sent something. A user who became away due to
+// inactivity is online again. It's called for every message from the clients,
+// so it doesn't wait for the status change to be published.
+func (u *UserManager) MarkActive(userName string) {
+	if u.cfg.AwayTimeout <= 0 {
+		return
+	}
+	u.activityMutex.Lock()
+	defer u.activityMutex.Unlock()
+	// The user isn't connected to this server
+	if _, ok := u.localActiveAt[userName]; !ok {
+		return
+	}
+	u.localActiveAt[userName] = u.now()
+	_, autoAway := u.autoAway[userName]
+	_, comingBack := u.comingBack[userName]
+	if autoAway && !comingBack {
+		u.comingBack[userName] = struct{}{}
+		go u.comeBack(userName)
+	}
+}
+
+func (u *UserManager) comeBack(userName string) {
+	var msgs []*api.Msg
+	u.localUsersMutex.Lock()
+	u.activityMutex.Lock()
+	delete(u.comingBack, userName)
+	// The user might have chosen a status meanwhile
+	_, autoAway := u.autoAway[userName]
+	u.activityMutex.Unlock()
+	if autoAway {
+		msgs = u.comeBackLocked(userName)
+	}
+	u.localUsersMutex.Unlock()
+	if err := u.publish(msgs); err != nil {
+		log.Errorf("Can't set status: %v", err)
+	}
+}
+
+// checkAway makes away the online users who haven't been active on any server
+// for AwayTimeout. The users this server made away, who were active elsewhere
+// since then, are online again.
+func (u *UserManager) checkAway(now time.Time) {
+	if u.cfg.AwayTimeout <= 0 {
+		return
+	}
+	var away, back []string
+	var batches [][]*api.Msg
+	u.localUsersMutex.Lock()
+	u.activityMutex.Lock()
+	for userName, activeAt := range u.localActiveAt {
+		u.serversMutex.Lock()
+		for _, server := range u.servers {
+			if t := server.activeAt[userName]; t.After(activeAt) {
+				activeAt = t
+			}
+		}
+		u.serversMutex.Unlock()
+
+		_, autoAway := u.autoAway[userName]
+		idle := now.Sub(activeAt) >= u.cfg.AwayTimeout
+		switch {
+		case idle && u.localStatuses[userName].Status == api.StatusOnline:
+			u.autoAway[userName] = struct{}{}
+			away = append(away, userName)
+		case !idle && autoAway:
+			back = append(back, userName)
+		}
+	}
+	u.activityMutex.Unlock()
+	for _, userName := range away {
+		status := u.localStatuses[userName]
+		batches = append(batches, u.setStatusLocked(userName, api.StatusAway, status.StatusText))
+	}
+	for _, userName := range back {
+		batches = append(batches, u.comeBackLocked(userName))
+	}
+	u.localUsersMutex.Unlock()
+
+	for _, msgs := range batches {
+		if err := u.publish(msgs); err != nil {
+			log.Errorf("Can't set status: %v", err)
+		}
+	}
+}
+
+// comeBackLocked makes the user this server made away online again
+func (u *UserManager) comeBackLocked(userName string) []*api.Msg {
+	u.activityMutex.Lock()
+	delete(u.autoAway, userName)
+	u.activityMutex.Unlock()
+	status := u.localStatuses[userName]
+	if status.Status != api.StatusAway {
+		return nil
+	}
+	return u.setStatusLocked(userName, api.StatusOnline, status.StatusText)
+}
+
+func (u *UserManager) nextVersionLocked() int64 {
+	u.version++
+	return u.version
+}
+
+// heartbeatLocked builds the heartbeat with the current users of the server
+func (u *UserManager) heartbeatLocked() *api.Msg {
+	heartbeat := &api.ServerHeartbeat{
+		ServerID: u.serverID,
+		Version:  u.nextVersionLocked(),
+	}
+	u.activityMutex.Lock()
+	if len(u.localActiveAt) > 0 {
+		heartbeat.ActiveAt = make(map[string]time.Time, len(u.localActiveAt))
+		for name, activeAt := range u.localActiveAt {
+			heartbeat.ActiveAt[name] = activeAt
+		}
+	}
+	u.activityMutex.Unlock()
+	for room, names := range u.localUsers {
+		users := api.UsersOnline{
+			Room: room,
+			List: make([]api.UserPresence, 0, len(names)),
+		}
+		for name := range names {
+			users.List = append(users.List, u.localStatuses[name])
+		}
+		heartbeat.Rooms = append(heartbeat.Rooms, users)
+	}
+
+	return &api.Msg{
+		Type:   api.TypeServerHeartbeat,
+		SentAt: time.Now(),
+		Msg:    heartbeat,
+	}
+}
+
+// NotifyUserJoined is called for every session of the user, but other servers
+// are notified only about the first one
+func (u *UserManager) NotifyUserJoined(room, userName string) error {
+	u.localUsersMutex.Lock()
+	msgs := u.userJoinedLocked(room, userName)
+	u.localUsersMutex.Unlock()
+	return u.publish(msgs)
+}
+
+func (u *UserManager) userJoinedLocked(room, userName string) []*api.Msg {
+	first := u.localUsers.add(room, userName)
+	if _, ok := u.localStatuses[userName]; !ok {
+		u.localStatuses[userName] = api.UserPresence{
+			UserName: userName,
+			Status:   api.StatusOnline,
+		}
+	}
+	// Joining is an activity too
+	if u.cfg.AwayTimeout > 0 {
+		u.activityMutex.Lock()
+		u.localActiveAt[userName] = u.now()
+		u.activityMutex.Unlock()
+	}
+	if !first {
+		return nil
+	}
 
 	msg := &api.Msg{
 		Type:   "user_joined",
 		SentAt: time.Now(),
 		Msg: &api.UserJoinedMsg{
 			UserName: userName,
+			Room:     room,
+			ServerID: u.serverID,
+			Version:  u.nextVersionLocked(),
 		},
 	}
-	return u.pulbishMsg(msg)
+	return u.changeLocked(msg)
 }
 
-func (u *UserManager) NotifyUserLeft(userName string) error {
+// NotifyUserLeft is called for every session of the user, but other servers
+// are notified only when the last one ends
+func (u *UserManager) NotifyUserLeft(room, userName string) error {
+	var comeBack []*api.Msg
 	u.localUsersMutex.Lock()
-	u.localUsers[userName] = struct{}{}
+	last := u.localUsers.remove(room, userName)
+	if !u.localUsers.hasUser(userName) {
+		// Sessions of the user on other servers shouldn't stay away because of
+		// the sessions that are gone, those servers make the user away again if
+		// they are inactive there too
+		u.activityMutex.Lock()
+		_, autoAway := u.autoAway[userName]
+		delete(u.localActiveAt, userName)
+		u.activityMutex.Unlock()
+		if autoAway {
+			comeBack = u.comeBackLocked(userName)
+		}
+		delete(u.localStatuses, userName)
+	}
+	var msgs []*api.Msg
+	if last {
+		msg := &api.Msg{
+			Type:   "user_left",
+			SentAt: time.Now(),
+			Msg: &api.UserLeftMsg{
+				UserName: userName,
+				Room:     room,
+				ServerID: u.serverID,
+				Version:  u.nextVersionLocked(),
+			},
+		}
+		msgs = u.changeLocked(msg)
+	}
 	u.localUsersMutex.Unlock()
 
-	msg := &api.Msg{
-		Type:   "user_left",
-		SentAt: time.Now(),
-		Msg: &api.UserLeftMsg{
-			UserName: userName,
-		},
+	if err := u.publish(comeBack); err != nil {
+		log.Errorf("Can't set status: %v", err)
+	}
+	return u.publish(msgs)
+}
+
+// changeLocked builds the event followed by the heartbeat, so the latest
+// message of the server in the snapshot is the heartbeat
+func (u *UserManager) changeLocked(msg *api.Msg) []*api.Msg {
+	return u.batchLocked(msg, u.heartbeatLocked())
+}
+
+// batchLocked returns the messages to publish once the lock is released,
+// or nil after the server left. Leave waits until they are published.
+func (u *UserManager) batchLocked(msgs ...*api.Msg) []*api.Msg {
+	if u.left {
+		return nil
 	}
-	return u.pulbishMsg(msg)
+	u.publishing.Add(1)
+	return msgs
 }
 
-func (u *UserManager) pulbishMsg(msg *api.Msg) error {
+// publish publishes the messages of a batch in order
+func (u *UserManager) publish(msgs []*api.Msg) error {
+	if msgs == nil {
+		return nil
+	}
+	defer u.publishing.Done()
+	for _, msg := range msgs {
+		if err := u.pulbishMsg(u.serverID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Presence events of a server are keyed by server ID to keep their order
+func (u *UserManager) pulbishMsg(key string, msg *api.Msg) error {
 	rawMsg, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	u.users.Publish(rawMsg)
-	return nil
+	return u.users.Publish(key, rawMsg)
 }
@@ -2,109 +2,472 @@ package users
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ig0rmin/ich/internal/api"
-	"github.com/ig0rmin/ich/internal/config"
-	"github.com/ig0rmin/ich/internal/kafka"
+	"github.com/ig0rmin/ich/internal/bus"
 	"github.com/stretchr/testify/require"
 )
 
 type MockServer struct {
-	users       *kafka.Kafka
 	userManager *UserManager
 }
 
 func (m *MockServer) Close() {
-	m.users.Wait()
-	m.users.Close()
 	m.userManager.Close()
 }
 
-func NewMockServer(t *testing.T, ctx context.Context) *MockServer {
-	var cfg kafka.Config
-	require.NoError(t, config.Load(&cfg))
-
-	users, err := kafka.NewKafka(cfg, "topic-users")
-	require.NoError(t, err)
-
-	go users.Run(ctx)
+// All the mock servers share the same users bus, like real servers share the Kafka topic
+func NewMockServer(t *testing.T, users bus.Compacted) *MockServer {
+	return NewMockServerWithConfig(t, users, Config{
+		HeartbeatInterval: time.Second,
+		TTL:               3 * time.Second,
+	})
+}
 
-	um, err := NewUserManager(users)
+func NewMockServerWithConfig(t *testing.T, users bus.Compacted, cfg Config) *MockServer {
+	um, err := NewUserManager(users, cfg)
 	require.NoError(t, err)
 
-	um.Init()
+	require.NoError(t, um.Init(context.Background()))
 
 	return &MockServer{
-		users:       users,
 		userManager: um,
 	}
 }
 
 type MockUsersListener struct {
-	Joined []string
-	Left   []string
+	Joined        []string
+	Left          []string
+	StatusChanged []string
+	mutex         sync.Mutex
 }
 
 func (l *MockUsersListener) ReceiveUserJoined(msg *api.UserJoinedMsg) {
+	l.mutex.Lock()
 	l.Joined = append(l.Joined, msg.UserName)
+	l.mutex.Unlock()
 }
 
 func (l *MockUsersListener) ReceiveUserLeft(msg *api.UserLeftMsg) {
+	l.mutex.Lock()
 	l.Left = append(l.Left, msg.UserName)
+	l.mutex.Unlock()
 }
 
-func TestUserManager(t *testing.T) {
+func (l *MockUsersListener) ReceiveUserStatusChanged(msg *api.UserStatusChanged) {
+	l.mutex.Lock()
+	l.StatusChanged = append(l.StatusChanged, msg.UserName+":"+msg.Status)
+	l.mutex.Unlock()
+}
+
+func (l *MockUsersListener) Len() (joined int, left int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.Joined), len(l.Left)
+}
+
+func newUsersBus(t *testing.T) *bus.CompactedMemory {
 	ctx, cancel := context.WithCancel(context.Background())
+	users := bus.NewCompactedMemory()
+	go users.Run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		users.Wait()
+	})
+	return users
+}
+
+// Names of the users online in the room
+func usersOnline(server *MockServer, room string) []string {
+	var res []string
+	for _, user := range server.userManager.GetUsersOnline(room) {
+		res = append(res, user.UserName)
+	}
+	return res
+}
+
+func requireUsersOnline(t *testing.T, server *MockServer, room string, count int) {
+	require.Eventually(t, func() bool {
+		return len(server.userManager.GetUsersOnline(room)) == count
+	}, time.Second, 10*time.Millisecond)
+}
 
-	server1 := NewMockServer(t, ctx)
+func TestUserManager(t *testing.T) {
+	users := newUsersBus(t)
+
+	server1 := NewMockServer(t, users)
 	defer server1.Close()
-	defer cancel()
 
 	var userListener MockUsersListener
-	server1.userManager.Subscribe(&userListener)
-
-	server1.userManager.NotifyUserJoined("Spongebob")
-	server1.userManager.NotifyUserJoined("Patrick")
+	server1.userManager.Subscribe("lobby", &userListener)
 
-	// Let Kafka time to process messages
-	time.Sleep(500 * time.Millisecond)
+	server1.userManager.NotifyUserJoined("lobby", "Spongebob")
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
 
-	require.Equal(t, 2, len(server1.userManager.GetUsersOnline()))
-	require.Contains(t, server1.userManager.GetUsersOnline(), "Spongebob")
-	require.Contains(t, server1.userManager.GetUsersOnline(), "Patrick")
+	requireUsersOnline(t, server1, "lobby", 2)
+	require.Contains(t, usersOnline(server1, "lobby"), "Spongebob")
+	require.Contains(t, usersOnline(server1, "lobby"), "Patrick")
 
-	server2 := NewMockServer(t, ctx)
+	server2 := NewMockServer(t, users)
 	defer server2.Close()
-	defer cancel()
-
-	// Let Kafka time to process messages
-	time.Sleep(500 * time.Millisecond)
 
 	// server2 know about users from server1
-	require.Equal(t, 2, len(server2.userManager.GetUsersOnline()))
-	require.Contains(t, server2.userManager.GetUsersOnline(), "Spongebob")
-	require.Contains(t, server2.userManager.GetUsersOnline(), "Patrick")
+	requireUsersOnline(t, server2, "lobby", 2)
+	require.Contains(t, usersOnline(server2, "lobby"), "Spongebob")
+	require.Contains(t, usersOnline(server2, "lobby"), "Patrick")
 
 	// Spongebob leaves
-	server1.userManager.NotifyUserLeft("Spongebob")
-
-	// Let Kafka time to process messages
-	time.Sleep(500 * time.Millisecond)
+	server1.userManager.NotifyUserLeft("lobby", "Spongebob")
 
 	// server1 has the correct list of users
-	require.Equal(t, 1, len(server2.userManager.GetUsersOnline()))
-	require.Contains(t, server2.userManager.GetUsersOnline(), "Patrick")
+	requireUsersOnline(t, server1, "lobby", 1)
+	require.Contains(t, usersOnline(server1, "lobby"), "Patrick")
 
 	// server2 has the correct list of users
-	require.Equal(t, 1, len(server2.userManager.GetUsersOnline()))
-	require.Contains(t, server2.userManager.GetUsersOnline(), "Patrick")
+	requireUsersOnline(t, server2, "lobby", 1)
+	require.Contains(t, usersOnline(server2, "lobby"), "Patrick")
 
 	// Check that listener received all the events
-	require.Equal(t, 2, len(userListener.Joined))
+	require.Eventually(t, func() bool {
+		joined, left := userListener.Len()
+		return joined == 2 && left == 1
+	}, time.Second, 10*time.Millisecond)
 	require.Contains(t, userListener.Joined, "Patrick")
 	require.Contains(t, userListener.Joined, "Spongebob")
-	require.Equal(t, 1, len(userListener.Left))
 	require.Contains(t, userListener.Left, "Spongebob")
 }
+
+func TestUserManagerRooms(t *testing.T) {
+	users := newUsersBus(t)
+
+	server := NewMockServer(t, users)
+	defer server.Close()
+
+	var lobbyListener, gameListener MockUsersListener
+	server.userManager.Subscribe("lobby", &lobbyListener)
+	server.userManager.Subscribe("game", &gameListener)
+
+	server.userManager.NotifyUserJoined("lobby", "Spongebob")
+	server.userManager.NotifyUserJoined("game", "Patrick")
+
+	requireUsersOnline(t, server, "lobby", 1)
+	requireUsersOnline(t, server, "game", 1)
+
+	require.Equal(t, []string{"Spongebob"}, usersOnline(server, "lobby"))
+	require.Equal(t, []string{"Patrick"}, usersOnline(server, "game"))
+
+	require.Eventually(t, func() bool {
+		lobbyJoined, _ := lobbyListener.Len()
+		gameJoined, _ := gameListener.Len()
+		return lobbyJoined == 1 && gameJoined == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"Spongebob"}, lobbyListener.Joined)
+	require.Equal(t, []string{"Patrick"}, gameListener.Joined)
+}
+
+func TestUserManagerEviction(t *testing.T) {
+	users := newUsersBus(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server1 := NewMockServerWithConfig(t, users, Config{
+		HeartbeatInterval: 20 * time.Millisecond,
+		TTL:               100 * time.Millisecond,
+	})
+	defer server1.Close()
+	go server1.userManager.Run(ctx)
+
+	var userListener MockUsersListener
+	server1.userManager.Subscribe("lobby", &userListener)
+
+	// server2 never sends heartbeats, as if it was killed right after Patrick joined
+	server2 := NewMockServer(t, users)
+	server2.userManager.NotifyUserJoined("lobby", "Patrick")
+	server1.userManager.NotifyUserJoined("lobby", "Spongebob")
+
+	requireUsersOnline(t, server1, "lobby", 2)
+	server2.Close()
+
+	// Users of the silent server are gone, the users of the live server stay
+	requireUsersOnline(t, server1, "lobby", 1)
+	require.Equal(t, []string{"Spongebob"}, usersOnline(server1, "lobby"))
+
+	require.Eventually(t, func() bool {
+		_, left := userListener.Len()
+		return left == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"Patrick"}, userListener.Left)
+}
+
+func TestUserManagerSessions(t *testing.T) {
+	users := newUsersBus(t)
+
+	server1 := NewMockServer(t, users)
+	defer server1.Close()
+	server2 := NewMockServer(t, users)
+	defer server2.Close()
+
+	var userListener MockUsersListener
+	server1.userManager.Subscribe("lobby", &userListener)
+
+	// Patrick opens two tabs on server1 and one more on server2
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	server2.userManager.NotifyUserJoined("lobby", "Patrick")
+	requireUsersOnline(t, server1, "lobby", 1)
+	requireUsersOnline(t, server2, "lobby", 1)
+
+	// Closing some of the tabs doesn't make him leave
+	server1.userManager.NotifyUserLeft("lobby", "Patrick")
+	server2.userManager.NotifyUserLeft("lobby", "Patrick")
+	server1.userManager.NotifyUserJoined("lobby", "Spongebob")
+	requireUsersOnline(t, server1, "lobby", 2)
+	requireUsersOnline(t, server2, "lobby", 2)
+
+	// Closing the last one does
+	server1.userManager.NotifyUserLeft("lobby", "Patrick")
+	requireUsersOnline(t, server1, "lobby", 1)
+	requireUsersOnline(t, server2, "lobby", 1)
+	require.Equal(t, []string{"Spongebob"}, usersOnline(server2, "lobby"))
+
+	require.Eventually(t, func() bool {
+		joined, left := userListener.Len()
+		return joined == 2 && left == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"Patrick", "Spongebob"}, userListener.Joined)
+	require.Equal(t, []string{"Patrick"}, userListener.Left)
+}
+
+func TestUserManagerStatus(t *testing.T) {
+	users := newUsersBus(t)
+
+	server1 := NewMockServer(t, users)
+	defer server1.Close()
+	server2 := NewMockServer(t, users)
+	defer server2.Close()
+
+	var lobbyListener, gameListener MockUsersListener
+	server2.userManager.Subscribe("lobby", &lobbyListener)
+	server2.userManager.Subscribe("game", &gameListener)
+
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	server1.userManager.NotifyUserJoined("game", "Patrick")
+	requireUsersOnline(t, server2, "lobby", 1)
+	requireUsersOnline(t, server2, "game", 1)
+	require.Equal(t, api.StatusOnline, server2.userManager.GetStatus("Patrick").Status)
+
+	require.ErrorIs(t, server1.userManager.SetStatus("Patrick", "sleeping", ""), ErrInvalidStatus)
+	require.NoError(t, server1.userManager.SetStatus("Patrick", api.StatusBusy, "Fishing"))
+
+	// The status is the same in every room and on every server
+	require.Eventually(t, func() bool {
+		lobby := server2.userManager.GetUsersOnline("lobby")
+		game := server2.userManager.GetUsersOnline("game")
+		return lobby[0].Status == api.StatusBusy && game[0].Status == api.StatusBusy
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "Fishing", server2.userManager.GetStatus("Patrick").StatusText)
+
+	require.Eventually(t, func() bool {
+		lobbyListener.mutex.Lock()
+		defer lobbyListener.mutex.Unlock()
+		gameListener.mutex.Lock()
+		defer gameListener.mutex.Unlock()
+		return len(lobbyListener.StatusChanged) == 1 && len(gameListener.StatusChanged) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"Patrick:busy"}, lobbyListener.StatusChanged)
+
+	// New servers learn the status from heartbeats
+	server3 := NewMockServer(t, users)
+	defer server3.Close()
+	require.Eventually(t, func() bool {
+		return server3.userManager.GetStatus("Patrick").Status == api.StatusBusy
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUserManagerAway(t *testing.T) {
+	users := newUsersBus(t)
+
+	cfg := Config{
+		HeartbeatInterval: time.Second,
+		TTL:               3 * time.Second,
+		AwayTimeout:       time.Minute,
+	}
+	start := time.Now()
+	var now atomic.Int64
+	clock := func() time.Time {
+		return start.Add(time.Duration(now.Load()))
+	}
+	server1 := NewMockServerWithConfig(t, users, cfg)
+	defer server1.Close()
+	server1.userManager.now = clock
+	server2 := NewMockServerWithConfig(t, users, cfg)
+	defer server2.Close()
+	server2.userManager.now = clock
+
+	requireStatus := func(status string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return server1.userManager.GetStatus("Patrick").Status == status &&
+				server2.userManager.GetStatus("Patrick").Status == status
+		}, time.Second, 10*time.Millisecond)
+	}
+	// Activity is advertised with the heartbeats
+	requireActiveAt := func(activeAt time.Time) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			server1.userManager.serversMutex.Lock()
+			defer server1.userManager.serversMutex.Unlock()
+			server := server1.userManager.servers[server2.userManager.serverID]
+			return server != nil && server.activeAt["Patrick"].Equal(activeAt)
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// Patrick has two tabs on server1 and one more on server2
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	server2.userManager.NotifyUserJoined("lobby", "Patrick")
+	requireUsersOnline(t, server1, "lobby", 1)
+
+	// He is active on server2 only, so he stays online
+	now.Store(int64(30 * time.Second))
+	server2.userManager.MarkActive("Patrick")
+	server2.userManager.publishHeartbeat()
+	requireActiveAt(clock())
+	server1.userManager.checkAway(start.Add(70 * time.Second))
+	requireStatus(api.StatusOnline)
+
+	// Until he is inactive everywhere
+	server1.userManager.checkAway(start.Add(100 * time.Second))
+	requireStatus(api.StatusAway)
+
+	// Activity on another server brings him back
+	now.Store(int64(100 * time.Second))
+	server2.userManager.MarkActive("Patrick")
+	server2.userManager.publishHeartbeat()
+	requireActiveAt(clock())
+	server1.userManager.checkAway(start.Add(101 * time.Second))
+	requireStatus(api.StatusOnline)
+
+	// As well as on the same one, right away
+	server1.userManager.checkAway(start.Add(200 * time.Second))
+	requireStatus(api.StatusAway)
+	server1.userManager.MarkActive("Patrick")
+	requireStatus(api.StatusOnline)
+
+	// The status chosen by the user isn't changed
+	require.NoError(t, server2.userManager.SetStatus("Patrick", api.StatusBusy, ""))
+	requireStatus(api.StatusBusy)
+	server1.userManager.checkAway(start.Add(time.Hour))
+	server2.userManager.checkAway(start.Add(time.Hour))
+	requireStatus(api.StatusBusy)
+}
+
+func TestUserManagerSnapshot(t *testing.T) {
+	users := newUsersBus(t)
+
+	server1 := NewMockServer(t, users)
+	defer server1.Close()
+	server1.userManager.NotifyUserJoined("lobby", "Spongebob")
+	server1.userManager.NotifyUserJoined("game", "Patrick")
+	server1.userManager.SetStatus("Patrick", api.StatusAway, "")
+
+	// A new server knows all the users as soon as it's initialized
+	server2 := NewMockServer(t, users)
+	defer server2.Close()
+	require.Equal(t, []string{"Spongebob"}, usersOnline(server2, "lobby"))
+	require.Equal(t, []string{"Patrick"}, usersOnline(server2, "game"))
+	require.Equal(t, api.StatusAway, server2.userManager.GetStatus("Patrick").Status)
+
+	// Servers that are gone for longer than TTL are ignored
+	server3 := NewMockServerWithConfig(t, users, Config{
+		HeartbeatInterval: time.Nanosecond,
+		TTL:               2 * time.Nanosecond,
+	})
+	defer server3.Close()
+	require.Empty(t, server3.userManager.GetUsersOnline("lobby"))
+}
+
+func TestUserManagerLeave(t *testing.T) {
+	users := newUsersBus(t)
+
+	server1 := NewMockServer(t, users)
+	defer server1.Close()
+	server2 := NewMockServer(t, users)
+	defer server2.Close()
+
+	var userListener MockUsersListener
+	server2.userManager.Subscribe("lobby", &userListener)
+
+	server1.userManager.NotifyUserJoined("lobby", "Patrick")
+	requireUsersOnline(t, server2, "lobby", 1)
+
+	// The server shuts down without waiting for its users to leave
+	server1.userManager.Leave()
+	requireUsersOnline(t, server2, "lobby", 0)
+	require.Eventually(t, func() bool {
+		_, left := userListener.Len()
+		return left == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// And it's not in the snapshot anymore
+	server3 := NewMockServer(t, users)
+	defer server3.Close()
+	require.Empty(t, server3.userManager.GetUsersOnline("lobby"))
+}
+
+func TestUserManagerStaleMessages(t *testing.T) {
+	server := NewMockServer(t, newUsersBus(t))
+	defer server.Close()
+
+	receive := func(seq int64, msg *api.Msg) {
+		t.Helper()
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		require.NoError(t, server.userManager.Receive(&bus.Message{Key: "other", Seq: seq, Data: data}))
+	}
+	heartbeat := func(version int64, userName string) *api.Msg {
+		return &api.Msg{
+			Type:   api.TypeServerHeartbeat,
+			SentAt: time.Now(),
+			Msg: &api.ServerHeartbeat{
+				ServerID: "other",
+				Version:  version,
+				Rooms: []api.UsersOnline{{
+					Room: "lobby",
+					List: []api.UserPresence{{UserName: userName, Status: api.StatusOnline}},
+				}},
+			},
+		}
+	}
+
+	// The other server built the second heartbeat after the first one,
+	// but published it earlier
+	receive(1, heartbeat(2, "Patrick"))
+	receive(2, heartbeat(1, "Spongebob"))
+	require.Equal(t, []string{"Patrick"}, usersOnline(server, "lobby"))
+
+	receive(3, &api.Msg{
+		Type:   api.TypeUserLeft,
+		SentAt: time.Now(),
+		Msg:    &api.UserLeftMsg{UserName: "Patrick", Room: "lobby", ServerID: "other", Version: 1},
+	})
+	require.Equal(t, []string{"Patrick"}, usersOnline(server, "lobby"))
+}
+
+func TestUserManagerConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{HeartbeatInterval: 0, TTL: time.Second},
+		{HeartbeatInterval: time.Second, TTL: time.Second},
+		{HeartbeatInterval: time.Second, TTL: 0},
+	} {
+		_, err := NewUserManager(bus.NewCompactedMemory(), cfg)
+		require.Error(t, err, cfg)
+	}
+}
@@ -1,53 +1,143 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/history"
 	"github.com/ig0rmin/ich/internal/messages"
+	"github.com/ig0rmin/ich/internal/ratelimit"
+	"github.com/ig0rmin/ich/internal/typing"
 	"github.com/ig0rmin/ich/internal/users"
 )
 
+// What to do when a client doesn't read messages as fast as they come
+const (
+	// Drop the oldest messages the client hasn't received yet
+	PolicyDropOldest = "drop_oldest"
+	// Close the connection, so the client can reconnect and resume
+	PolicyDisconnect = "disconnect"
+)
+
+// Last message sent to the client before the server closes the connection
+type closing struct {
+	msg  *api.Msg
+	code int
+	text string
+}
+
 type Client struct {
 	userName string
-	conn     *websocket.Conn
-	messages *messages.Messages
-	userMgr  *users.UserManager
-	publish  chan any
+	// Login session the client connected with
+	sessionID string
+	room      string
+	// Moderators can edit and delete messages of other users
+	moderator bool
+	cfg       Config
+	conn      *websocket.Conn
+	messages  *messages.Messages
+	userMgr   *users.UserManager
+	typing    *typing.Typing
+	history   *history.Repository
+	// Limits messages of the user
+	limiter *ratelimit.Limiter
+
+	// Messages waiting to be sent to the client. Receiving messages never blocks,
+	// so a slow client doesn't delay other clients.
+	queue    []any
+	overflow bool
+	closed   bool
+	// Set when the server is shutting down or the session is revoked
+	closing    *closing
+	queueMutex sync.Mutex
+	notify     chan struct{}
+	done       chan struct{}
+	// Messages dropped for this client and for all the clients
+	dropped      int64
+	droppedTotal *atomic.Int64
+
+	// Last typing notification sent on behalf of the client
+	lastTyping time.Time
+}
+
+// ClientInfo tells who the client is and where it's connected
+type ClientInfo struct {
+	UserName string
+	// Login session the client connected with, empty for the tokens
+	// of an external identity provider
+	SessionID string
+	Room      string
+	// Moderators can edit and delete messages of other users
+	Moderator bool
 }
 
-func NewClient(conn *websocket.Conn, userName string, userMgr *users.UserManager, msg *messages.Messages) (*Client, error) {
-	c := &Client{
-		userName: userName,
-		conn:     conn,
-		messages: msg,
-		userMgr:  userMgr,
-		publish:  make(chan any),
+func NewClient(conn *websocket.Conn, info ClientInfo, cfg Config, deps Deps, droppedTotal *atomic.Int64) *Client {
+	return &Client{
+		userName:  info.UserName,
+		sessionID: info.SessionID,
+		room:      info.Room,
+		moderator: info.Moderator,
+		cfg:       cfg,
+		conn:      conn,
+		messages:  deps.Messages,
+		userMgr:   deps.UserMgr,
+		typing:    deps.Typing,
+		history:   deps.History,
+		limiter:   deps.MsgLimiter,
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+
+		droppedTotal: droppedTotal,
 	}
-	return c, nil
 }
 
 func (c *Client) Init() {
-	c.messages.Subscribe(c)
-	c.userMgr.Subscribe(c)
+	c.messages.Subscribe(c.room, c)
+	c.messages.SubscribeDirect(c.userName, c)
+	c.userMgr.Subscribe(c.room, c)
+	c.typing.Subscribe(c.room, c)
 }
 
 func (c *Client) Close() {
-	c.messages.Unsubscribe(c)
-	c.userMgr.Unsubscribe(c)
-}
+	c.messages.Unsubscribe(c.room, c)
+	c.messages.UnsubscribeDirect(c.userName, c)
+	c.userMgr.Unsubscribe(c.room, c)
+	c.typing.Unsubscribe(c.room, c)
 
-func (c *Client) ReceiveChatMessage(sentAt time.Time, chatMsg *api.ChatMessage) {
-	msg := &api.Msg{
-		Type:   api.TypeChatMessage,
-		SentAt: time.Now(),
-		Msg:    chatMsg,
+	c.queueMutex.Lock()
+	c.closed = true
+	c.queue = nil
+	dropped := c.dropped
+	c.queueMutex.Unlock()
+	close(c.done)
+
+	if dropped > 0 {
+		log.Printf("Dropped %v messages for the slow client %v", dropped, c.userName)
 	}
-	c.publish <- msg
+}
+
+func (c *Client) ReceiveChatMessage(msg *api.Msg, chatMsg *api.ChatMessage) {
+	c.send(msg)
+}
+
+func (c *Client) ReceiveMessageEdited(msg *api.Msg, edited *api.MessageEdited) {
+	c.send(msg)
+}
+
+func (c *Client) ReceiveMessageDeleted(msg *api.Msg, deleted *api.MessageDeleted) {
+	c.send(msg)
+}
+
+func (c *Client) ReceiveDirectMessage(msg *api.Msg, directMsg *api.DirectMessage) {
+	c.send(msg)
 }
 
 func (c *Client) ReceiveUserJoined(user *api.UserJoinedMsg) {
@@ -56,7 +146,7 @@ func (c *Client) ReceiveUserJoined(user *api.UserJoinedMsg) {
 		SentAt: time.Now(),
 		Msg:    user,
 	}
-	c.publish <- msg
+	c.send(msg)
 }
 
 func (c *Client) ReceiveUserLeft(user *api.UserLeftMsg) {
@@ -65,31 +155,197 @@ func (c *Client) ReceiveUserLeft(user *api.UserLeftMsg) {
 		SentAt: time.Now(),
 		Msg:    user,
 	}
-	c.publish <- msg
+	c.send(msg)
+}
+
+func (c *Client) ReceiveUserStatusChanged(user *api.UserStatusChanged) {
+	msg := &api.Msg{
+		Type:   api.TypeUserStatusChanged,
+		SentAt: time.Now(),
+		Msg:    user,
+	}
+	c.send(msg)
+}
+
+func (c *Client) ReceiveUserTyping(user *api.UserTyping) {
+	msg := &api.Msg{
+		Type:   api.TypeUserTyping,
+		SentAt: time.Now(),
+		Msg:    user,
+	}
+	c.send(msg)
+}
+
+func (c *Client) ReceiveUserStoppedTyping(user *api.UserTyping) {
+	msg := &api.Msg{
+		Type:   api.TypeUserStoppedTyping,
+		SentAt: time.Now(),
+		Msg:    user,
+	}
+	c.send(msg)
 }
 
-func (c *Client) write() {
+// send queues the message for the client without blocking
+func (c *Client) send(msg any) {
+	c.queueMutex.Lock()
+	if c.closed || c.overflow {
+		c.queueMutex.Unlock()
+		return
+	}
+	if len(c.queue) >= c.cfg.SendQueueSize {
+		if c.cfg.SlowClientPolicy == PolicyDisconnect {
+			c.overflow = true
+		} else {
+			c.queue = c.queue[1:]
+		}
+		c.dropped++
+		c.droppedTotal.Add(1)
+	}
+	if !c.overflow {
+		c.queue = append(c.queue, msg)
+	}
+	c.queueMutex.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) write(replay []*api.Msg) {
 	defer c.conn.Close()
 
 	// Send the list of users online as the first message to the new client
-	if err := c.conn.WriteJSON(c.usersOnline()); err != nil {
+	if err := c.writeJSON(c.usersOnline()); err != nil {
 		return
 	}
 
+	// Followed by the chat history
+	replayed := make(map[string]struct{}, len(replay))
+	for _, msg := range replay {
+		if err := c.writeJSON(msg); err != nil {
+			return
+		}
+		replayed[msg.ID] = struct{}{}
+	}
+
+	// Pings make sure the client is still there
+	ping := time.NewTicker(c.cfg.PingInterval)
+	defer ping.Stop()
+
+	// And the messages received since the client subscribed,
+	// the first of them might be in the history already
 	for {
-		msg, ok := <-c.publish
-		if !ok {
+		select {
+		case <-c.notify:
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.WriteTimeout)); err != nil {
+				return
+			}
+			continue
+		case <-c.done:
 			return
 		}
-		if err := c.conn.WriteJSON(msg); err != nil {
-			break
+
+		c.queueMutex.Lock()
+		queue := c.queue
+		c.queue = nil
+		overflow := c.overflow
+		closing := c.closing
+		c.queueMutex.Unlock()
+
+		if overflow {
+			log.Printf("Disconnecting the slow client %v", c.userName)
+			c.closeConn(websocket.CloseTryAgainLater, "too slow")
+			return
 		}
+		for _, msg := range queue {
+			if m, ok := msg.(*api.Msg); ok && m.ID != "" {
+				if _, ok := replayed[m.ID]; ok {
+					continue
+				}
+			}
+			if err := c.writeJSON(msg); err != nil {
+				return
+			}
+		}
+
+		if closing != nil {
+			if err := c.writeJSON(closing.msg); err != nil {
+				return
+			}
+			c.closeConn(closing.code, closing.text)
+			return
+		}
+	}
+}
+
+// Shutdown sends the queued messages to the client, followed by the reconnect
+// message, and closes the connection
+func (c *Client) Shutdown(reconnect *api.Reconnect) {
+	c.close(&closing{
+		msg: &api.Msg{
+			Type:   api.TypeReconnect,
+			SentAt: time.Now(),
+			Msg:    reconnect,
+		},
+		code: websocket.CloseGoingAway,
+		text: "server is shutting down",
+	})
+}
+
+// Revoke sends the queued messages to the client, followed by the session_revoked
+// error, and closes the connection. The client shouldn't reconnect with the same token.
+func (c *Client) Revoke() {
+	c.close(&closing{
+		msg: &api.Msg{
+			Type:   api.TypeError,
+			SentAt: time.Now(),
+			Msg: &api.Error{
+				Code: api.ErrorSessionRevoked,
+				Text: "The session is revoked",
+			},
+		},
+		code: websocket.ClosePolicyViolation,
+		text: "session revoked",
+	})
+}
+
+func (c *Client) close(closing *closing) {
+	c.queueMutex.Lock()
+	c.closing = closing
+	c.queueMutex.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
 	}
 }
 
-func (c *Client) read() {
+func (c *Client) closeConn(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.cfg.WriteTimeout))
+}
+
+// A client that doesn't read messages for too long is disconnected
+func (c *Client) writeJSON(msg any) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+// read processes the messages from the client until the connection is closed.
+// The context is canceled when the connection is closed by either side.
+func (c *Client) read(ctx context.Context) {
 	defer c.conn.Close()
 
+	// Larger messages make the connection close with 1009 (message too big)
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	// The client must answer pings, otherwise the connection is considered dead
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongTimeout))
+	})
+
 	for {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
@@ -99,28 +355,205 @@ func (c *Client) read() {
 			break
 		}
 
+		c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongTimeout))
+
 		log.Printf("Websockets received message: %v", strings.TrimSuffix(string(msg), "\n"))
-		c.processChatMessage(msg)
+		c.userMgr.MarkActive(c.userName)
+		c.processMessage(ctx, msg)
 	}
 }
 
-func (c *Client) processChatMessage(data []byte) {
-	chatMsg := &api.ChatMessage{}
+func (c *Client) processMessage(ctx context.Context, data []byte) {
+	var raw json.RawMessage
 	msg := &api.Msg{
-		Msg: chatMsg,
+		Msg: &raw,
 	}
 	if err := json.Unmarshal(data, msg); err != nil {
-		log.Printf("Can't parse JSON")
+		c.sendError("", errInvalidMessage)
 		return
 	}
-	if msg.Type != api.TypeChatMessage {
-		log.Printf("Unsupported message type: %v", msg.Type)
-		return
+	var err error
+	switch msg.Type {
+	case api.TypeChatMessage, api.TypeDirectMessage, api.TypeEditMessage, api.TypeDeleteMessage:
+		if !c.limiter.Allow(ctx, c.userName) {
+			err = errTooManyMessages
+			break
+		}
+		err = c.processBusMessage(ctx, msg, raw)
+	case api.TypeTyping:
+		err = c.processTyping()
+	case api.TypeSetStatus:
+		err = c.processSetStatus(raw)
+	default:
+		err = errUnsupportedType
 	}
-	// Prevent spoofing user name
+	if err != nil {
+		c.sendError(msg.ClientMsgID, err)
+	}
+}
+
+// Messages published to the messages bus are rate limited
+func (c *Client) processBusMessage(ctx context.Context, msg *api.Msg, raw json.RawMessage) error {
+	switch msg.Type {
+	case api.TypeChatMessage:
+		return c.processChatMessage(msg.ClientMsgID, raw)
+	case api.TypeDirectMessage:
+		return c.processDirectMessage(msg.ClientMsgID, raw)
+	case api.TypeEditMessage:
+		return c.processEditMessage(ctx, raw)
+	case api.TypeDeleteMessage:
+		return c.processDeleteMessage(ctx, raw)
+	}
+	return errUnsupportedType
+}
+
+func (c *Client) checkText(text string) error {
+	if text == "" {
+		return errNoText
+	}
+	if utf8.RuneCountInString(text) > c.cfg.MaxTextLength {
+		return errTooLong
+	}
+	return nil
+}
+
+func (c *Client) processChatMessage(clientMsgID string, data []byte) error {
+	chatMsg := &api.ChatMessage{}
+	if err := json.Unmarshal(data, chatMsg); err != nil {
+		return errInvalidMessage
+	}
+	if err := c.checkText(chatMsg.Text); err != nil {
+		return err
+	}
+	// Prevent spoofing user name and posting to other rooms
 	chatMsg.From = c.userName
+	chatMsg.Room = c.room
+	chatMsg.EditedAt = nil
+
+	msg, err := c.messages.PostChatMessage(chatMsg)
+	return c.ack(clientMsgID, msg, err)
+}
+
+func (c *Client) processDirectMessage(clientMsgID string, data []byte) error {
+	directMsg := &api.DirectMessage{}
+	if err := json.Unmarshal(data, directMsg); err != nil {
+		return errInvalidMessage
+	}
+	if directMsg.To == "" {
+		return errNoRecipient
+	}
+	if err := c.checkText(directMsg.Text); err != nil {
+		return err
+	}
+	// Prevent spoofing user name
+	directMsg.From = c.userName
+
+	msg, err := c.messages.PostDirectMessage(directMsg)
+	return c.ack(clientMsgID, msg, err)
+}
+
+// ack tells the client its message was published, if the client wants to know
+func (c *Client) ack(clientMsgID string, msg *api.Msg, err error) error {
+	if err != nil {
+		log.Printf("Can't publish the message: %v", err)
+		return errDeliveryFailed
+	}
+	if clientMsgID == "" {
+		return nil
+	}
+	c.send(&api.Msg{
+		Type:        api.TypeAck,
+		SentAt:      time.Now(),
+		ClientMsgID: clientMsgID,
+		Msg: &api.Ack{
+			ID:          msg.ID,
+			SentAt:      msg.SentAt,
+			ClientMsgID: clientMsgID,
+		},
+	})
+	return nil
+}
+
+func (c *Client) processEditMessage(ctx context.Context, data []byte) error {
+	edit := &api.EditMessage{}
+	if err := json.Unmarshal(data, edit); err != nil {
+		return errInvalidMessage
+	}
+	if err := c.checkText(edit.Text); err != nil {
+		return err
+	}
+	chatMsg, err := c.authorizeChange(ctx, edit.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.messages.PostMessageEdited(&api.MessageEdited{
+		ID:       edit.ID,
+		Room:     chatMsg.Room,
+		Text:     edit.Text,
+		EditedBy: c.userName,
+	})
+}
 
-	c.messages.PostChatMessage(chatMsg)
+func (c *Client) processDeleteMessage(ctx context.Context, data []byte) error {
+	del := &api.DeleteMessage{}
+	if err := json.Unmarshal(data, del); err != nil {
+		return errInvalidMessage
+	}
+	chatMsg, err := c.authorizeChange(ctx, del.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.messages.PostMessageDeleted(&api.MessageDeleted{
+		ID:        del.ID,
+		Room:      chatMsg.Room,
+		DeletedBy: c.userName,
+	})
+}
+
+// Clients send typing notifications on every keystroke, the extra ones
+// are dropped silently
+func (c *Client) processTyping() error {
+	now := time.Now()
+	if now.Sub(c.lastTyping) < c.cfg.TypingInterval {
+		return nil
+	}
+	c.lastTyping = now
+	return c.typing.NotifyTyping(c.room, c.userName)
+}
+
+func (c *Client) processSetStatus(data []byte) error {
+	status := &api.SetStatus{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return errInvalidMessage
+	}
+	return c.userMgr.SetStatus(c.userName, status.Status, status.StatusText)
+}
+
+// Only the author of the message or a moderator can change it
+func (c *Client) authorizeChange(ctx context.Context, messageID string) (*api.ChatMessage, error) {
+	// Messages can't be changed without the database
+	if c.history == nil {
+		return nil, errNoHistory
+	}
+	// The history gets the messages with a delay, so the message just sent
+	// is only known to the bus
+	chatMsg, recent := c.messages.RecentChatMessage(messageID)
+	if recent && chatMsg == nil {
+		return nil, errNotFound
+	}
+	if !recent {
+		record, err := c.history.GetChatMessage(ctx, messageID)
+		if err != nil {
+			return nil, err
+		}
+		chatMsg = &record.ChatMessage
+	}
+	if chatMsg.From != c.userName && !c.moderator {
+		return nil, errPermissionDenied
+	}
+	return chatMsg, nil
 }
 
 func (c *Client) usersOnline() *api.Msg {
@@ -128,7 +561,8 @@ func (c *Client) usersOnline() *api.Msg {
 		Type:   api.TypeUsersOnline,
 		SentAt: time.Now(),
 		Msg: &api.UsersOnline{
-			List: c.userMgr.GetUsersOnline(),
+			Room: c.room,
+			List: c.userMgr.GetUsersOnline(c.room),
 		},
 	}
 	return msg
@@ -0,0 +1,427 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/bus"
+	"github.com/ig0rmin/ich/internal/history"
+	"github.com/ig0rmin/ich/internal/messages"
+	"github.com/ig0rmin/ich/internal/ratelimit"
+	"github.com/ig0rmin/ich/internal/typing"
+	"github.com/ig0rmin/ich/internal/user"
+	"github.com/ig0rmin/ich/internal/users"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig returns a valid config with a short send queue and timeouts
+func testConfig() Config {
+	return Config{
+		SendQueueSize:    2,
+		SlowClientPolicy: PolicyDropOldest,
+		PingInterval:     time.Second,
+		PongTimeout:      2 * time.Second,
+		WriteTimeout:     time.Second,
+		AuthTimeout:      time.Second,
+		MaxMessageSize:   1024,
+		MaxTextLength:    100,
+	}
+}
+
+// testDeps returns the dependencies without any limits, tests add the services they need
+func testDeps() Deps {
+	store := ratelimit.NewMemoryStore()
+	return Deps{
+		ConnLimiter:     ratelimit.NewLimiter(store, "connections", 0, 0),
+		MsgLimiter:      ratelimit.NewLimiter(store, "messages", 0, 0),
+		AnonConnLimiter: ratelimit.NewLimiter(store, "anonymous-connections", 0, 0),
+	}
+}
+
+var testClientInfo = ClientInfo{
+	UserName:  "Patrick",
+	SessionID: "session-1",
+	Room:      "lobby",
+}
+
+func newTestClient(conn *websocket.Conn, cfg Config, deps Deps) *Client {
+	return NewClient(conn, testClientInfo, cfg, deps, &atomic.Int64{})
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	var dropped atomic.Int64
+	c := NewClient(nil, testClientInfo, testConfig(), testDeps(), &dropped)
+
+	c.send(1)
+	c.send(2)
+	c.send(3)
+
+	require.Equal(t, []any{2, 3}, c.queue)
+	require.False(t, c.overflow)
+	require.Equal(t, int64(1), c.dropped)
+	require.Equal(t, int64(1), dropped.Load())
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	var dropped atomic.Int64
+	cfg := testConfig()
+	cfg.SlowClientPolicy = PolicyDisconnect
+	c := NewClient(nil, testClientInfo, cfg, testDeps(), &dropped)
+
+	c.send(1)
+	c.send(2)
+	c.send(3)
+	c.send(4)
+
+	// The client is disconnected on the first overflow, so it doesn't get anything else
+	require.Equal(t, []any{1, 2}, c.queue)
+	require.True(t, c.overflow)
+	require.Equal(t, int64(1), c.dropped)
+	require.Equal(t, int64(1), dropped.Load())
+}
+
+func TestConfig(t *testing.T) {
+	cfg := testConfig()
+	require.NoError(t, cfg.Validate())
+
+	cfg.SlowClientPolicy = "ignore"
+	require.Error(t, cfg.Validate())
+
+	// Nothing can be queued, not even dropped
+	cfg.SlowClientPolicy = PolicyDropOldest
+	cfg.SendQueueSize = 0
+	require.Error(t, cfg.Validate())
+
+	cfg.SendQueueSize = 1
+	require.NoError(t, cfg.Validate())
+
+	// Pongs can't arrive before the pings
+	cfg.PingInterval = time.Second
+	cfg.PongTimeout = time.Second
+	require.Error(t, cfg.Validate())
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		cfg := testConfig()
+		cfg.MaxMessageSize = 16
+		c := newTestClient(conn, cfg, testDeps())
+		c.read(context.Background())
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 17))))
+
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+}
+
+func TestShutdown(t *testing.T) {
+	userMgr, err := users.NewUserManager(bus.NewCompactedMemory(), users.Config{HeartbeatInterval: time.Second, TTL: 3 * time.Second})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		deps := testDeps()
+		deps.UserMgr = userMgr
+		c := newTestClient(conn, testConfig(), deps)
+		c.Shutdown(&api.Reconnect{RetryAfterMs: 100})
+		c.write(nil)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var msg api.Msg
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, api.TypeUsersOnline, msg.Type)
+
+	reconnect := &api.Reconnect{}
+	msg = api.Msg{Msg: reconnect}
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, api.TypeReconnect, msg.Type)
+	require.Equal(t, int64(100), reconnect.RetryAfterMs)
+
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
+
+func TestRevoke(t *testing.T) {
+	userMgr, err := users.NewUserManager(bus.NewCompactedMemory(), users.Config{HeartbeatInterval: time.Second, TTL: 3 * time.Second})
+	require.NoError(t, err)
+
+	deps := testDeps()
+	deps.UserMgr = userMgr
+	h := NewHandler(testConfig(), history.Config{}, deps)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c := newTestClient(conn, testConfig(), deps)
+		h.addClient(c)
+		defer h.removeClient(c)
+		// Only the clients of the revoked session are disconnected
+		h.ReceiveSessionRevoked(&api.SessionRevoked{SessionID: "session-2"})
+		h.ReceiveSessionRevoked(&api.SessionRevoked{SessionID: "session-1"})
+		c.write(nil)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var msg api.Msg
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, api.TypeUsersOnline, msg.Type)
+
+	clientErr := &api.Error{}
+	msg = api.Msg{Msg: clientErr}
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, api.TypeError, msg.Type)
+	require.Equal(t, api.ErrorSessionRevoked, clientErr.Code)
+
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+}
+
+func requireError(t *testing.T, c *Client, code, clientMsgID string) {
+	t.Helper()
+	require.Len(t, c.queue, 1)
+	msg := c.queue[0].(*api.Msg)
+	c.queue = nil
+	require.Equal(t, api.TypeError, msg.Type)
+	require.Equal(t, clientMsgID, msg.ClientMsgID)
+	clientErr := msg.Msg.(*api.Error)
+	require.Equal(t, code, clientErr.Code)
+	require.Equal(t, clientMsgID, clientErr.ClientMsgID)
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig()
+	cfg.MaxTextLength = 5
+	c := newTestClient(nil, cfg, testDeps())
+
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "msg": `))
+	requireError(t, c, api.ErrorInvalidMessage, "")
+
+	c.processMessage(ctx, []byte(`{"type": "dance", "client_msg_id": "1"}`))
+	requireError(t, c, api.ErrorUnsupportedType, "1")
+
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "client_msg_id": "2", "msg": {"text": "Hello!"}}`))
+	requireError(t, c, api.ErrorTooLong, "2")
+
+	c.processMessage(ctx, []byte(`{"type": "direct_message", "client_msg_id": "3", "msg": {"text": "Hi"}}`))
+	requireError(t, c, api.ErrorInvalidMessage, "3")
+
+	// Messages can't be edited without the chat history
+	c.processMessage(ctx, []byte(`{"type": "edit_message", "client_msg_id": "4", "msg": {"id": "1", "text": "Hi"}}`))
+	requireError(t, c, api.ErrorUnsupportedType, "4")
+}
+
+// Bus that can't publish anything
+type failingBus struct {
+	*bus.Memory
+}
+
+func (b failingBus) Publish(key string, data []byte) error {
+	return errors.New("no brokers available")
+}
+
+func TestAck(t *testing.T) {
+	ctx := context.Background()
+	msgs, err := messages.NewMessages(bus.NewMemory())
+	require.NoError(t, err)
+
+	deps := testDeps()
+	deps.Messages = msgs
+	c := newTestClient(nil, testConfig(), deps)
+
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "client_msg_id": "1", "msg": {"text": "Hello!"}}`))
+	require.Len(t, c.queue, 1)
+	msg := c.queue[0].(*api.Msg)
+	require.Equal(t, api.TypeAck, msg.Type)
+	ack := msg.Msg.(*api.Ack)
+	require.NotEmpty(t, ack.ID)
+	require.Equal(t, "1", ack.ClientMsgID)
+	c.queue = nil
+
+	// No ack without client_msg_id
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "msg": {"text": "Hello!"}}`))
+	require.Empty(t, c.queue)
+
+	c.messages, err = messages.NewMessages(failingBus{bus.NewMemory()})
+	require.NoError(t, err)
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "client_msg_id": "2", "msg": {"text": "Hello!"}}`))
+	requireError(t, c, api.ErrorDeliveryFailed, "2")
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	ctx := context.Background()
+	msgs, err := messages.NewMessages(bus.NewMemory())
+	require.NoError(t, err)
+
+	deps := testDeps()
+	deps.Messages = msgs
+	deps.MsgLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), "messages", 0.001, 2)
+	c := newTestClient(nil, testConfig(), deps)
+
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "msg": {"text": "Hello!"}}`))
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "msg": {"text": "Hello!"}}`))
+	require.Empty(t, c.queue)
+
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "client_msg_id": "1", "msg": {"text": "Hello!"}}`))
+	requireError(t, c, api.ErrorRateLimited, "1")
+
+	// Other users aren't limited
+	c.userName = "Sponge Bob"
+	c.processMessage(ctx, []byte(`{"type": "chat_message", "msg": {"text": "Hello!"}}`))
+	require.Empty(t, c.queue)
+}
+
+func TestTypingInterval(t *testing.T) {
+	ctx := context.Background()
+	typist, err := typing.NewTyping(bus.NewMemory(), typing.Config{TTL: time.Second})
+	require.NoError(t, err)
+
+	deps := testDeps()
+	deps.Typing = typist
+	cfg := testConfig()
+	cfg.TypingInterval = time.Hour
+	c := newTestClient(nil, cfg, deps)
+
+	// Notifications sent too often are dropped without an error
+	c.processMessage(ctx, []byte(`{"type": "typing", "client_msg_id": "1"}`))
+	c.processMessage(ctx, []byte(`{"type": "typing", "client_msg_id": "2"}`))
+	require.Empty(t, c.queue)
+}
+
+func TestAuthMessage(t *testing.T) {
+	authenticate := func(c *gin.Context, msg *api.Auth) error {
+		if msg.Token != "valid" {
+			return errors.New("Unauthorized")
+		}
+		c.Set(user.UserNameKey, "Patrick")
+		return nil
+	}
+	deps := testDeps()
+	deps.Authenticate = authenticate
+	h := NewHandler(testConfig(), history.Config{}, deps)
+
+	authenticated := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		if err := h.authenticateConn(c, conn); err != nil {
+			h.reject(conn, api.ErrorUnauthorized, err.Error(), websocket.ClosePolicyViolation)
+			return
+		}
+		authenticated <- c.GetString(user.UserNameKey)
+		conn.Close()
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	requireRejected := func(conn *websocket.Conn) {
+		t.Helper()
+		clientErr := &api.Error{}
+		msg := api.Msg{Msg: clientErr}
+		require.NoError(t, conn.ReadJSON(&msg))
+		require.Equal(t, api.TypeError, msg.Type)
+		require.Equal(t, api.ErrorUnauthorized, clientErr.Code)
+		_, _, err := conn.ReadMessage()
+		require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(&api.Msg{Type: api.TypeAuth, Msg: &api.Auth{Token: "valid"}}))
+	require.Equal(t, "Patrick", <-authenticated)
+
+	// The auth message must be the first one
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(&api.Msg{Type: api.TypeChatMessage, Msg: &api.ChatMessage{Text: "Hi"}}))
+	requireRejected(conn)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(&api.Msg{Type: api.TypeAuth, Msg: &api.Auth{Token: "forged"}}))
+	requireRejected(conn)
+
+	// And sent in time
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	requireRejected(conn)
+}
+
+func TestAnonymousConnectionLimit(t *testing.T) {
+	deps := testDeps()
+	deps.AnonConnLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), "anonymous-connections", 0.001, 1)
+	deps.Authenticate = func(c *gin.Context, msg *api.Auth) error {
+		return errors.New("Unauthorized")
+	}
+	h := NewHandler(testConfig(), history.Config{}, deps)
+	router := gin.New()
+	h.Route(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/join"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The next handshake from the same IP isn't upgraded
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestResumeWithoutHistory(t *testing.T) {
+	h := NewHandler(testConfig(), history.Config{}, testDeps())
+	router := gin.New()
+	h.Route(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// The client would miss the messages if the server ignored since
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/join?since=42", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,67 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/history"
+	"github.com/ig0rmin/ich/internal/users"
+)
+
+// clientError is a rejection reported to the client in the error message
+type clientError struct {
+	code string
+	text string
+}
+
+func (e *clientError) Error() string {
+	return e.text
+}
+
+var (
+	errInvalidMessage   = &clientError{api.ErrorInvalidMessage, "Can't parse the message"}
+	errUnsupportedType  = &clientError{api.ErrorUnsupportedType, "Unsupported message type"}
+	errNoRecipient      = &clientError{api.ErrorInvalidMessage, "Direct message without recipient"}
+	errNoText           = &clientError{api.ErrorInvalidMessage, "Message without text"}
+	errInvalidStatus    = &clientError{api.ErrorInvalidMessage, "Invalid status"}
+	errTooLong          = &clientError{api.ErrorTooLong, "Message text is too long"}
+	errTooManyMessages  = &clientError{api.ErrorRateLimited, "Too many messages, slow down"}
+	errPermissionDenied = &clientError{api.ErrorPermissionDenied, "Permission denied"}
+	errNotFound         = &clientError{api.ErrorNotFound, "Message not found"}
+	errNoHistory        = &clientError{api.ErrorUnsupportedType, "Messages can't be changed, the chat history is disabled"}
+	errDeliveryFailed   = &clientError{api.ErrorDeliveryFailed, "Can't deliver the message, try again"}
+	errInternal         = &clientError{api.ErrorInternal, "Internal server error"}
+	errAuthExpected     = &clientError{api.ErrorUnauthorized, "Auth message expected"}
+)
+
+// toClientError hides the details of unexpected errors from the client
+func toClientError(err error) *clientError {
+	var clientErr *clientError
+	switch {
+	case errors.As(err, &clientErr):
+		return clientErr
+	case errors.Is(err, history.ErrNotFound):
+		return errNotFound
+	case errors.Is(err, users.ErrInvalidStatus):
+		return errInvalidStatus
+	default:
+		log.Printf("Can't process the message: %v", err)
+		return errInternal
+	}
+}
+
+func (c *Client) sendError(clientMsgID string, err error) {
+	clientErr := toClientError(err)
+	c.send(&api.Msg{
+		Type:        api.TypeError,
+		SentAt:      time.Now(),
+		ClientMsgID: clientMsgID,
+		Msg: &api.Error{
+			Code:        clientErr.code,
+			Text:        clientErr.text,
+			ClientMsgID: clientMsgID,
+		},
+	})
+}
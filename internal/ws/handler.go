@@ -1,64 +1,435 @@
 package ws
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/ig0rmin/ich/internal/api"
+	"github.com/ig0rmin/ich/internal/history"
 	"github.com/ig0rmin/ich/internal/messages"
+	"github.com/ig0rmin/ich/internal/ratelimit"
+	"github.com/ig0rmin/ich/internal/typing"
 	"github.com/ig0rmin/ich/internal/user"
 	"github.com/ig0rmin/ich/internal/users"
 )
 
+type Config struct {
+	// Users allowed to edit and delete messages of other users
+	Moderators []string `env:"ICH_MODERATORS, delimiter=;"`
+	// Typing notifications from a client more frequent than this are ignored
+	TypingInterval time.Duration `env:"ICH_WS_TYPING_INTERVAL, default=1s"`
+	// Messages waiting to be sent to a client, when the queue is full
+	// the slow client policy applies
+	SendQueueSize int `env:"ICH_WS_SEND_QUEUE_SIZE, default=256"`
+	// "drop_oldest" or "disconnect"
+	SlowClientPolicy string `env:"ICH_WS_SLOW_CLIENT_POLICY, default=drop_oldest"`
+	// How often the server pings the client
+	PingInterval time.Duration `env:"ICH_WS_PING_INTERVAL, default=30s"`
+	// The connection is closed if there is no pong for this long, must be greater than PingInterval
+	PongTimeout time.Duration `env:"ICH_WS_PONG_TIMEOUT, default=60s"`
+	// The connection is closed if a message can't be written for this long
+	WriteTimeout time.Duration `env:"ICH_WS_WRITE_TIMEOUT, default=10s"`
+	// Max size of a message from the client in bytes
+	MaxMessageSize int64 `env:"ICH_WS_MAX_MESSAGE_SIZE, default=65536"`
+	// Max length of a chat message text in characters
+	MaxTextLength int `env:"ICH_WS_MAX_TEXT_LENGTH, default=4000"`
+	// On shutdown clients are told to reconnect after a random delay up to this,
+	// so they don't all reconnect at once
+	ReconnectSpread time.Duration `env:"ICH_WS_RECONNECT_SPREAD, default=5s"`
+	// Clients connecting without credentials must send the auth message within this time
+	AuthTimeout time.Duration `env:"ICH_WS_AUTH_TIMEOUT, default=5s"`
+}
+
+// Validate checks the config once on start, the clients rely on it
+func (cfg *Config) Validate() error {
+	if cfg.SendQueueSize < 1 {
+		return errors.New("websocket send queue size must be at least 1")
+	}
+	switch cfg.SlowClientPolicy {
+	case PolicyDropOldest, PolicyDisconnect:
+	default:
+		return fmt.Errorf("unsupported slow client policy: %v", cfg.SlowClientPolicy)
+	}
+	if cfg.PingInterval <= 0 || cfg.PongTimeout <= cfg.PingInterval {
+		return errors.New("pong timeout must be greater than ping interval")
+	}
+	return nil
+}
+
+const (
+	// Subprotocol of the chat. Clients passing the token as a subprotocol must
+	// offer it too, browsers require the server to confirm one of the offered.
+	Subprotocol = "ich"
+	// Browsers can't set the Authorization header, so they may pass the token
+	// as the "bearer.<token>" subprotocol
+	TokenSubprotocolPrefix = "bearer."
+)
+
+// Authenticate authenticates the client by the auth message, and sets the user
+// in the context as the auth middleware does
+type Authenticate func(c *gin.Context, msg *api.Auth) error
+
+// Deps are the services shared by the handler and its clients
+type Deps struct {
+	UserMgr  *users.UserManager
+	Messages *messages.Messages
+	Typing   *typing.Typing
+	// Nil when the server runs without the database
+	History *history.Repository
+	Sink    *history.Sink
+
+	// Limit connections and messages per user
+	ConnLimiter *ratelimit.Limiter
+	MsgLimiter  *ratelimit.Limiter
+	// Limits connections without credentials per IP
+	AnonConnLimiter *ratelimit.Limiter
+
+	Authenticate Authenticate
+	CheckOrigin  func(*http.Request) bool
+}
+
 type Handler struct {
-	msg     *messages.Messages
-	userMgr *users.UserManager
+	cfg        Config
+	historyCfg history.Config
+	deps       Deps
+	upgrader   websocket.Upgrader
+
+	// Messages dropped for slow clients
+	dropped atomic.Int64
+
+	// Connected clients
+	clients      map[*Client]struct{}
+	draining     bool
+	clientsMutex sync.Mutex
+	// Joins in progress, including the clients being connected
+	joins sync.WaitGroup
 }
 
-func NewHandler(userMgr *users.UserManager, msg *messages.Messages) *Handler {
-	return &Handler{
-		msg:     msg,
-		userMgr: userMgr,
+func NewHandler(cfg Config, historyCfg history.Config, deps Deps) *Handler {
+	h := &Handler{
+		cfg:        cfg,
+		historyCfg: historyCfg,
+		deps:       deps,
+		upgrader:   upgrader,
+		clients:    make(map[*Client]struct{}),
 	}
+	h.upgrader.CheckOrigin = deps.CheckOrigin
+	return h
+}
+
+// DroppedMessages returns the number of messages dropped for slow clients since the start
+func (h *Handler) DroppedMessages() int64 {
+	return h.dropped.Load()
 }
 
 func (h *Handler) Route(root gin.IRouter) {
 	root.GET("/join", h.Join)
 }
 
+// Without CheckOrigin the upgrader accepts only the same origin
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	Subprotocols:    []string{Subprotocol},
+}
+
+const maxRoomNameLength = 64
+
+// Room names are limited to letters, digits, '-' and '_'
+func validRoomName(room string) bool {
+	if room == "" || len(room) > maxRoomNameLength {
+		return false
+	}
+	for _, r := range room {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Drain disconnects all the clients telling them to reconnect, and waits until they
+// leave. New clients are rejected from now on.
+func (h *Handler) Drain(ctx context.Context) error {
+	h.clientsMutex.Lock()
+	h.draining = true
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.clientsMutex.Unlock()
+
+	log.Printf("Disconnecting %v websocket clients", len(clients))
+	for _, client := range clients {
+		client.Shutdown(h.reconnect())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.joins.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Handler) reconnect() *api.Reconnect {
+	var delay time.Duration
+	if h.cfg.ReconnectSpread > 0 {
+		delay = time.Duration(rand.Int63n(int64(h.cfg.ReconnectSpread)))
+	}
+	return &api.Reconnect{
+		RetryAfterMs: delay.Milliseconds(),
+	}
+}
+
+// ReceiveSessionRevoked disconnects the clients of the revoked session
+func (h *Handler) ReceiveSessionRevoked(revoked *api.SessionRevoked) {
+	// Clients with the tokens of an external identity provider have no session
+	if revoked.SessionID == "" {
+		return
+	}
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	for client := range h.clients {
+		if client.sessionID == revoked.SessionID {
+			log.Printf("Disconnecting %v, the session is revoked", client.userName)
+			client.Revoke()
+		}
+	}
+}
+
+// addClient returns false if the server is shutting down
+func (h *Handler) addClient(client *Client) bool {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	if h.draining {
+		return false
+	}
+	h.clients[client] = struct{}{}
+	return true
+}
+
+func (h *Handler) removeClient(client *Client) {
+	h.clientsMutex.Lock()
+	delete(h.clients, client)
+	h.clientsMutex.Unlock()
+}
+
+// startJoin returns false if the server is shutting down
+func (h *Handler) startJoin() bool {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	if h.draining {
+		return false
+	}
+	h.joins.Add(1)
+	return true
 }
 
 func (h *Handler) Join(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !h.startJoin() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
 		return
 	}
+	defer h.joins.Done()
 
-	log.Printf("New webscoket connection")
+	room := c.DefaultQuery("room", api.DefaultRoom)
+	if !validRoomName(room) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room name"})
+		return
+	}
 
+	// Resuming client sends the sequence number of the last message it received
+	since, resume := c.GetQuery("since")
+	var sinceSeq int64
+	if resume {
+		var err error
+		sinceSeq, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || sinceSeq < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since"})
+			return
+		}
+		// Without the database there is nothing to resume from
+		if h.deps.History == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Chat history is disabled, can't resume"})
+			return
+		}
+	}
+
+	// Clients that didn't authenticate with the request send the auth message
 	userName := c.GetString(user.UserNameKey)
-	h.userMgr.NotifyUserJoined(userName)
-	defer h.userMgr.NotifyUserLeft(userName)
+	authenticated := userName != ""
+	if authenticated && !h.deps.ConnLimiter.Allow(c.Request.Context(), userName) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many connections"})
+		return
+	}
+	// Every anonymous connection holds a goroutine until the auth timeout
+	if !authenticated && !h.deps.AnonConnLimiter.Allow(c.Request.Context(), c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many connections"})
+		return
+	}
 
-	client, err := NewClient(conn, userName, h.userMgr, h.msg)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Client"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+
+	if !authenticated {
+		if err := h.authenticateConn(c, conn); err != nil {
+			log.Printf("Websocket client failed to authenticate: %v", err)
+			h.reject(conn, api.ErrorUnauthorized, err.Error(), websocket.ClosePolicyViolation)
+			return
+		}
+		userName = c.GetString(user.UserNameKey)
+		if !h.deps.ConnLimiter.Allow(c.Request.Context(), userName) {
+			h.reject(conn, api.ErrorRateLimited, "Too many connections", websocket.CloseTryAgainLater)
+			return
+		}
+	}
+	log.Printf("New webscoket connection")
+
+	h.deps.UserMgr.NotifyUserJoined(room, userName)
+	defer h.deps.UserMgr.NotifyUserLeft(room, userName)
+
+	info := ClientInfo{
+		UserName:  userName,
+		SessionID: c.GetString(user.SessionIDKey),
+		Room:      room,
+		Moderator: slices.Contains(h.cfg.Moderators, userName),
+	}
+	client := NewClient(conn, info, h.cfg, h.deps, &h.dropped)
 	defer client.Close()
 
+	// The server started shutting down while the client was connecting
+	if !h.addClient(client) {
+		client.Shutdown(h.reconnect())
+	}
+	defer h.removeClient(client)
+
+	// Subscribe before loading the history, so no message is lost in between.
+	// The client queues live messages until the history is sent.
 	client.Init()
 
-	go client.write()
-	client.read()
+	var replay []*api.Msg
+	if h.deps.History != nil {
+		replay, err = h.loadHistory(c.Request.Context(), room, resume, sinceSeq)
+		if err != nil {
+			log.Printf("Failed to load chat history: %v", err)
+		}
+	}
+
+	// The request context isn't canceled when a hijacked connection closes, so the
+	// requests made for the client are canceled once the connection is done
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		client.write(replay)
+		cancel()
+	}()
+	client.read(ctx)
 
 	log.Printf("Websocket client left")
 }
+
+// authenticateConn reads the auth message, the client must send it first
+func (h *Handler) authenticateConn(c *gin.Context, conn *websocket.Conn) error {
+	conn.SetReadLimit(h.cfg.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(h.cfg.AuthTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return errAuthExpected
+	}
+	auth := &api.Auth{}
+	msg := &api.Msg{
+		Msg: auth,
+	}
+	if err := json.Unmarshal(data, msg); err != nil || msg.Type != api.TypeAuth {
+		return errAuthExpected
+	}
+	return h.deps.Authenticate(c, auth)
+}
+
+// reject sends the error to the client and closes the connection
+func (h *Handler) reject(conn *websocket.Conn, code, text string, closeCode int) {
+	defer conn.Close()
+	deadline := time.Now().Add(h.cfg.WriteTimeout)
+	conn.SetWriteDeadline(deadline)
+	err := conn.WriteJSON(&api.Msg{
+		Type:   api.TypeError,
+		SentAt: time.Now(),
+		Msg: &api.Error{
+			Code: code,
+			Text: text,
+		},
+	})
+	if err != nil {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, text), deadline)
+}
+
+// Joining waits this long for the messages received before it to be stored
+const historySyncTimeout = 5 * time.Second
+
+// loadHistory returns the messages to replay to the client subscribed to the room
+func (h *Handler) loadHistory(ctx context.Context, room string, resume bool, since int64) ([]*api.Msg, error) {
+	// The messages received before the client subscribed might still wait
+	// in the sink buffer, they must be in the database to be replayed
+	if h.deps.Sink != nil {
+		syncCtx, cancel := context.WithTimeout(ctx, historySyncTimeout)
+		err := h.deps.Sink.Sync(syncCtx)
+		cancel()
+		if err != nil {
+			log.Printf("Chat history may miss recent messages: %v", err)
+		}
+	}
+	if resume {
+		return h.resume(ctx, room, since)
+	}
+	return h.replay(ctx, room)
+}
+
+func (h *Handler) replay(ctx context.Context, room string) ([]*api.Msg, error) {
+	if h.historyCfg.ReplayLength <= 0 {
+		return nil, nil
+	}
+	records, err := h.deps.History.GetLastChatMessages(ctx, room, h.historyCfg.ReplayLength)
+	if err != nil {
+		return nil, err
+	}
+	return recordsToMsgs(records), nil
+}
+
+func (h *Handler) resume(ctx context.Context, room string, since int64) ([]*api.Msg, error) {
+	records, err := h.deps.History.GetChatMessagesSince(ctx, room, since, h.historyCfg.ResumeLength)
+	if err != nil {
+		return nil, err
+	}
+	return recordsToMsgs(records), nil
+}
+
+func recordsToMsgs(records []history.Record) []*api.Msg {
+	res := make([]*api.Msg, 0, len(records))
+	for i := range records {
+		res = append(res, records[i].Msg())
+	}
+	return res
+}